@@ -14,12 +14,17 @@ package gojsonrpc2datastreammultiplexer
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/AnimusPEXUS/goinmemfile"
@@ -34,6 +39,21 @@ const (
 	JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE     = "gbs"
 )
 
+// how long sender waits for transfer outcome ("tc"/"tf" request) since
+// last gbi/gbs request of the buffer (not since sending "n")
+const JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT = time.Minute
+
+// PushMessageFromOutside() restriction on size of single protocol message
+const JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE = 1050
+
+// base64 encoded slice together with response envelope must fit into
+// JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE
+const JSONRPC2_MULTIPLEXER_SLICE_SIZE = 512
+
+// how many slice requests receiver keeps in flight simultaneously
+// (for all incomming transfers in sum) by default
+const JSONRPC2_MULTIPLEXER_CONCURRENT_SLICE_REQUESTS = 4
+
 type JSONRPC2DataStreamMultiplexer struct {
 	PushMessageToOutsideCB func(data []byte) error
 
@@ -54,11 +74,96 @@ type JSONRPC2DataStreamMultiplexer struct {
 	// OnRequestToProvideWriteSeekerCB and OnIncommingDataTransferComplete
 	OnIncommingDataTransferComplete func(io.WriteSeeker)
 
-	buffer_wrappers        []*JSONRPC2DataStreamMultiplexerBufferWrapper
+	// called instead of OnIncommingDataTransferComplete, if sender waits
+	// for reply (see ChannelDataWithReply()). returned data is channelled
+	// back to sender. to reply with []byte, return bytes.NewReader().
+	// returned error is reported to sender. see JSONRPC2DataStreamMultiplexerReply.go
+	OnIncommingDataTransferReplyCB func(io.WriteSeeker) (io.ReadSeeker, error)
+
+	// if not nil - peer must pass handshake before it's n/gbi/gbs requests
+	// are served. see JSONRPC2DataStreamMultiplexerAuth.go
+	Authenticator JSONRPC2DataStreamMultiplexerAuthenticator
+
+	// if nil, DefaultJSONRPC2DataStreamMultiplexerRetryPolicy() is used.
+	// see JSONRPC2DataStreamMultiplexerRetryPolicy.go
+	RetryPolicy *JSONRPC2DataStreamMultiplexerRetryPolicy
+
+	rtt_estimator *rttEstimator
+
+	// called when peer stops answering pings.
+	// see JSONRPC2DataStreamMultiplexerKeepalive.go
+	OnPeerLost func()
+
+	// see JSONRPC2DataStreamMultiplexerShutdown.go
+	state_mutex        sync.Mutex
+	closed             bool
+	closed_chan        chan struct{}
+	shutting_down      bool
+	peer_going_away    bool
+	inflight_transfers sync.WaitGroup
+
+	keepalive_mutex sync.Mutex
+	keepalive_stop  chan struct{}
+	peer_lost_chan  chan struct{}
+
+	// how long announced buffer may stay not accessed by peer, before it's
+	// expired. 0 - JSONRPC2_MULTIPLEXER_BUFFER_IDLE_EXPIRY.
+	// see JSONRPC2DataStreamMultiplexerBufferExpiry.go
+	BufferIdleExpiry time.Duration
+
+	// if not nil, spans are created for transfers.
+	// see JSONRPC2DataStreamMultiplexerTracing.go
+	Tracer JSONRPC2DataStreamMultiplexerTracer
+
+	// if not nil, all incomming and outgoing messages are written to it.
+	// see JSONRPC2DataStreamMultiplexerRecorder.go
+	Recorder *JSONRPC2DataStreamMultiplexerRecorder
+
+	// if not nil, receives traffic and transfer events.
+	// see JSONRPC2DataStreamMultiplexerMetrics.go
+	Metrics JSONRPC2DataStreamMultiplexerMetrics
+
+	// consulted on every gbi/gbs request. if nil, default rule is used:
+	// buffer with not empty Audience is readable only by peer with same
+	// identity. see JSONRPC2DataStreamMultiplexerAuthorization.go
+	OnAuthorizeBufferReadCB func(
+		peer_identity string,
+		bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
+	) bool
+
+	auth_mutex         sync.Mutex
+	auth_challenge     []byte
+	peer_authenticated bool
+	peer_identity      string
+
+	// see JSONRPC2DataStreamMultiplexerBufferRegistry.go
+	buffer_wrappers        map[string]*JSONRPC2DataStreamMultiplexerBufferWrapper
 	buffer_wrappers_mutex2 *goreentrantlock.ReentrantMutexCheckable
 
+	// see JSONRPC2DataStreamMultiplexerIntrospection.go
+	incomming_transfers_mutex sync.Mutex
+	incomming_transfers       map[string]*incommingTransfer
+
+	// see JSONRPC2DataStreamMultiplexerPriority.go
+	priorities_mutex     sync.Mutex
+	response_priorities  map[string]outgoingResponse
+	incomming_priorities map[string]JSONRPC2DataStreamMultiplexerPriority
+	outgoing_gate        *priorityGate
+
+	receive_scheduler *JSONRPC2DataStreamMultiplexerReceiveScheduler
+
+	// see JSONRPC2DataStreamMultiplexerTokenBucket.go
+	limits_mutex    sync.Mutex
+	send_limiter    *JSONRPC2DataStreamMultiplexerTokenBucket
+	receive_limiter *JSONRPC2DataStreamMultiplexerTokenBucket
+
 	jrpc_node *gojsonrpc2.JSONRPC2Node
 
+	// see JSONRPC2DataStreamMultiplexerLog.go
+	base_logger   *slog.Logger
+	logger        *slog.Logger
+	recent_errors *recentErrors
+
 	debugName string
 
 	debug bool
@@ -68,8 +173,26 @@ func NewJSONRPC2DataStreamMultiplexer() *JSONRPC2DataStreamMultiplexer {
 	self := new(JSONRPC2DataStreamMultiplexer)
 	self.debug = false
 	self.debugName = "JSONRPC2DataStreamMultiplexer"
+	self.recent_errors = newRecentErrors(JSONRPC2_MULTIPLEXER_RECENT_ERRORS)
+	self.SetLogger(nil)
 
 	self.buffer_wrappers_mutex2 = goreentrantlock.NewReentrantMutexCheckable(false)
+	self.buffer_wrappers = make(map[string]*JSONRPC2DataStreamMultiplexerBufferWrapper)
+
+	self.incomming_transfers = make(map[string]*incommingTransfer)
+
+	self.rtt_estimator = new(rttEstimator)
+	self.peer_lost_chan = make(chan struct{})
+	self.closed_chan = make(chan struct{})
+
+	self.response_priorities = make(map[string]outgoingResponse)
+	self.incomming_priorities = make(map[string]JSONRPC2DataStreamMultiplexerPriority)
+	self.outgoing_gate = newPriorityGate(1)
+
+	self.receive_scheduler = NewJSONRPC2DataStreamMultiplexerReceiveScheduler(
+		JSONRPC2_MULTIPLEXER_CONCURRENT_PULLS,
+		JSONRPC2_MULTIPLEXER_CONCURRENT_SLICE_REQUESTS,
+	)
 
 	self.jrpc_node = gojsonrpc2.NewJSONRPC2Node()
 	self.jrpc_node.OnRequestCB = func(m *gojsonrpc2.Message) (error, error) {
@@ -96,29 +219,70 @@ func (self *JSONRPC2DataStreamMultiplexer) SetDebug(val bool) {
 func (self *JSONRPC2DataStreamMultiplexer) SetDebugName(name string) {
 	self.debugName = fmt.Sprintf("[%s]", name)
 	self.jrpc_node.SetDebugName(fmt.Sprintf("%s [JSONRPC2Node]", self.debugName))
+	self.SetLogger(self.base_logger)
 }
 
 func (self *JSONRPC2DataStreamMultiplexer) GetDebugName() string {
 	return self.debugName
 }
 
+// logged with Debug level. see JSONRPC2DataStreamMultiplexerLog.go
 func (self *JSONRPC2DataStreamMultiplexer) DebugPrintln(data ...any) {
-	fmt.Println(append(append([]any{}, self.debugName), data...)...)
+	self.logger.Debug(debugSprintln(data...))
 }
 
 func (self *JSONRPC2DataStreamMultiplexer) DebugPrintfln(format string, data ...any) {
-	fmt.Println(append(append([]any{}, self.debugName), fmt.Sprintf(format, data...))...)
+	self.logger.Debug(fmt.Sprintf(format, data...))
 }
 
+// Close is idempotent. after Close, public methods return ErrClosed.
+// requests waiting for peer's responses and pending receive loops are woken
+// with ErrClosed
 func (self *JSONRPC2DataStreamMultiplexer) Close() {
+	already := func() bool {
+		self.state_mutex.Lock()
+		defer self.state_mutex.Unlock()
+
+		if self.closed {
+			return true
+		}
+
+		self.closed = true
+		close(self.closed_chan)
+		return false
+	}()
+
+	if already {
+		return
+	}
+
+	self.StopKeepalive()
+	self.receive_scheduler.close()
 	self.jrpc_node.Close()
-	self.jrpc_node = nil
-	self.buffer_wrappers = nil
+
+	self.buffer_wrappers_mutex2.Lock()
+	defer self.buffer_wrappers_mutex2.Unlock()
+
+	self.buffer_wrappers = make(map[string]*JSONRPC2DataStreamMultiplexerBufferWrapper)
 }
 
+// sends request and waits for response.
+//
+// timeout == 0 - derive timeout from RetryPolicy and measured RTT.
+// pacing - how long peer is expected to delay response by rate limiting.
+// it's added to derived timeout.
+// if retry is true, retryable failures (see RetryPolicy.IsRetryable) are
+// retried according to RetryPolicy. request_id_hook is used only on first attempt.
+// if 'cancel' (may be nil) is closed, waiting is stopped with errRequestCanceled.
+// 'on_retry' (may be nil) is called before each retry
 func (self *JSONRPC2DataStreamMultiplexer) requestSendingRespWaitingRoutine(
 	msg *gojsonrpc2.Message,
 	request_id_hook *gojsonrpc2.JSONRPC2NodeNewRequestIdHook,
+	timeout time.Duration,
+	pacing time.Duration,
+	retry bool,
+	cancel <-chan struct{},
+	on_retry func(),
 ) (
 	timedout bool,
 	closed bool,
@@ -138,22 +302,100 @@ func (self *JSONRPC2DataStreamMultiplexer) requestSendingRespWaitingRoutine(
 		if self.debug {
 			self.DebugPrintln(
 				"requestSendingRespWaitingRoutine. defer results:",
-				timedout, closed, resp, proto_err, err,
+				timedout, closed, msgSummary(resp), proto_err, err,
 			)
 		}
 	}()
 
-	retry_countdown := 3
-retry_label:
+	policy := self.getRetryPolicy()
+
+	attempts := 1
+	if retry {
+		attempts = policy.Attempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		timedout, closed, resp, proto_err, err =
+			self.requestSendingRespWaitingRoutineAttempt(
+				msg,
+				request_id_hook,
+				self.requestTimeout(timeout, pacing, attempt),
+				cancel,
+			)
+
+		if !timedout && !closed && proto_err == nil && err == nil {
+			return
+		}
+
+		if attempt >= attempts || !policy.IsRetryable(timedout, closed, proto_err, err) {
+			return
+		}
+
+		request_id_hook = nil
+
+		backoff := policy.Backoff(attempt)
+
+		self.getMetrics().Retry(metricsMethod(msg.Method))
+		if on_retry != nil {
+			on_retry()
+		}
+
+		if self.debug {
+			self.DebugPrintln(
+				"requestSendingRespWaitingRoutine. retrying",
+				msg.Method, "after", backoff,
+				"attempt", attempt+1, "of", attempts,
+			)
+		}
+		self.logger.Debug(
+			"retrying request",
+			"method", msg.Method,
+			"request_id", msg.Id,
+			"attempt", attempt+1,
+			"attempts", attempts,
+			"backoff", backoff,
+			"timedout", timedout,
+			"err", err,
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-self.getPeerLostChan():
+			return false, false, nil, nil, ErrPeerLost
+		case <-self.closed_chan:
+			return false, true, nil, nil, ErrClosed
+		case <-cancel:
+			return false, false, nil, nil, errRequestCanceled
+		}
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) requestSendingRespWaitingRoutineAttempt(
+	msg *gojsonrpc2.Message,
+	request_id_hook *gojsonrpc2.JSONRPC2NodeNewRequestIdHook,
+	timeout time.Duration,
+	cancel <-chan struct{},
+) (
+	timedout bool,
+	closed bool,
+	resp *gojsonrpc2.Message,
+	proto_err error,
+	err error,
+) {
 
 	// todo: use NewChannelledJSONRPC2NodeRespHandler()
 
+	// buffered, so late callbacks never block the node
 	var (
-		chan_timeout  = make(chan struct{})
-		chan_close    = make(chan struct{})
-		chan_response = make(chan *gojsonrpc2.Message)
+		chan_timeout  = make(chan struct{}, 1)
+		chan_close    = make(chan struct{}, 1)
+		chan_response = make(chan *gojsonrpc2.Message, 1)
 	)
 
+	sent := time.Now()
+
+	peer_lost_chan := self.getPeerLostChan()
+
 	if self.debug {
 		self.DebugPrintln(
 			"requestSendingRespWaitingRoutine.",
@@ -161,6 +403,8 @@ retry_label:
 		)
 	}
 
+	self.getMetrics().MessageOut(metricsMethod(msg.Method))
+
 	_, err = self.jrpc_node.SendRequest(
 		msg,
 		true,
@@ -176,79 +420,70 @@ retry_label:
 				chan_response <- resp2
 			},
 		},
-		// mayde it's better to make this definable using parameter, but minute
-		// is timeout specified by protocol of Multiplexer
-		time.Minute,
+		timeout,
 		request_id_hook,
 	)
 	if self.debug {
 		self.DebugPrintln(
 			"requestSendingRespWaitingRoutine.",
 			"after self.jrpc_node.SendRequest",
-			timedout, closed, resp, proto_err, err,
+			timedout, closed, msgSummary(resp), proto_err, err,
 		)
 	}
 
 	if err != nil {
-		return false, false, nil, nil, err
+		return false, false, nil, nil, fmt.Errorf("%w: %w", ErrRequestNotSent, err)
 	}
 
 	select {
 	case <-chan_timeout:
 		if self.debug {
-			self.DebugPrintln("timeout waiting for buffer info from peer")
-		}
-		if retry_countdown != 0 {
-			retry_countdown--
-			if self.debug {
-				self.DebugPrintln("   retrying to get buffer info")
-			}
-			goto retry_label
+			self.DebugPrintln("timeout waiting for response from peer:", msg.Method, timeout)
 		}
+		self.getMetrics().Timeout(metricsMethod(msg.Method))
 		return true, false, nil, nil, errors.New("timeout")
 	case <-chan_close:
 		if self.debug {
 			self.DebugPrintln("waited for message from peer, but local node is closed")
 		}
-		return false, true, nil, nil, errors.New("node closed")
+		return false, true, nil, nil, ErrClosed
+	case <-self.closed_chan:
+		if self.debug {
+			self.DebugPrintln("waited for message from peer, but multiplexer is closed")
+		}
+		return false, true, nil, nil, ErrClosed
+	case <-cancel:
+		if self.debug {
+			self.DebugPrintln("waited for message from peer, but waiting is canceled")
+		}
+		return false, false, nil, nil, errRequestCanceled
+	case <-peer_lost_chan:
+		if self.debug {
+			self.DebugPrintln("waited for message from peer, but peer is lost")
+		}
+		return false, false, nil, nil, ErrPeerLost
 	case resp = <-chan_response:
 
+		self.rtt_estimator.Update(time.Since(sent))
+
 		proto_err := resp.IsInvalidError()
 		if proto_err != nil {
+			self.getMetrics().ProtocolError(metricsMethod(msg.Method))
 			return false, false, nil, proto_err, errors.New("protocol error")
 		}
 
-		return false, false, resp, nil, nil
-	}
-}
-
-// no re-entrant locks in golang
-func (self *JSONRPC2DataStreamMultiplexer) getBuffByIdLocal(id string) (
-	bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
-	ok bool,
-) {
-
-	if self.debug {
-		defer self.DebugPrintln("getBuffByIdLocal - exited")
-	}
-
-	if self.debug {
-		self.DebugPrintln("getBuffByIdLocal : before Lock()")
-	}
-
-	self.buffer_wrappers_mutex2.Lock()
-	defer self.buffer_wrappers_mutex2.Unlock()
-
-	if self.debug {
-		self.DebugPrintln("getBuffByIdLocal : after Lock()")
-	}
+		if resp.IsError() &&
+			resp.Error.Code == JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHENTICATED {
+			return false, false, resp, ErrPeerNotAuthenticated, errors.New("protocol error")
+		}
 
-	for _, x := range self.buffer_wrappers {
-		if x.BufferId == id {
-			return x, true
+		if resp.IsError() &&
+			resp.Error.Code == JSONRPC2_MULTIPLEXER_ERROR_CODE_GOING_AWAY {
+			return false, false, resp, nil, ErrPeerGoingAway
 		}
+
+		return false, false, resp, nil, nil
 	}
-	return nil, false
 }
 
 func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(
@@ -278,18 +513,211 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(
 		return false, false, proto_err, err
 	}
 
+	priority := JSONRPC2_MULTIPLEXER_PRIORITY_NORMAL
+	{
+		p_any, ok := msg_par["p"]
+		if ok {
+			p_float64, ok := p_any.(float64)
+			if !ok {
+				return false,
+					false,
+					errors.New("can't convert 'p' to int"),
+					errors.New("protocol error")
+			}
+			priority = JSONRPC2DataStreamMultiplexerPriority(p_float64).Normalize()
+		}
+	}
+
+	var transfer_limiter *JSONRPC2DataStreamMultiplexerTokenBucket
+	{
+		r_any, ok := msg_par["r"]
+		if ok {
+			r_float64, ok := r_any.(float64)
+			if !ok {
+				return false,
+					false,
+					errors.New("can't convert 'r' to int"),
+					errors.New("protocol error")
+			}
+			transfer_limiter = NewJSONRPC2DataStreamMultiplexerTokenBucket(
+				int64(r_float64),
+				0,
+			)
+		}
+	}
+
+	wants_reply := false
+	{
+		w_any, ok := msg_par["w"]
+		if ok {
+			wants_reply, ok = w_any.(bool)
+			if !ok {
+				return false,
+					false,
+					errors.New("can't convert 'w' to bool"),
+					errors.New("protocol error")
+			}
+		}
+	}
+
+	reply_to := ""
+	{
+		rt_any, ok := msg_par["rt"]
+		if ok {
+			reply_to, ok = rt_any.(string)
+			if !ok {
+				return false,
+					false,
+					errors.New("can't convert 'rt' to string"),
+					errors.New("protocol error")
+			}
+		}
+	}
+
+	idle_expiry := JSONRPC2_MULTIPLEXER_BUFFER_IDLE_EXPIRY
+	{
+		x_any, ok := msg_par["x"]
+		if ok {
+			x_float64, ok := x_any.(float64)
+			if !ok || x_float64 < 1 {
+				return false,
+					false,
+					errors.New("can't convert 'x' to positive int"),
+					errors.New("protocol error")
+			}
+			idle_expiry = time.Duration(x_float64) * time.Millisecond
+		}
+	}
+
+	trace_carrier, err := traceCarrierFrom_msg_par(msg_par)
+	if err != nil {
+		return false, false, err, errors.New("protocol error")
+	}
+
 	if self.debug {
 		self.DebugPrintfln("jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(%s)", buffid_str)
+		self.DebugPrintln("   priority:", priority)
+		self.DebugPrintln("   wants reply:", wants_reply, "reply to:", reply_to)
 	}
 
+	var reply_waiter *JSONRPC2DataStreamMultiplexerBufferWrapper
+	if reply_to != "" {
+		reply_waiter, err = self.getReplyWaiter(reply_to)
+		if err != nil {
+			return false, false, err, errors.New("protocol error")
+		}
+	}
+
+	err = self.beginTransfer()
+	if err != nil {
+		if reply_waiter != nil {
+			reply_waiter.reply <- &transferReply{err: err}
+		}
+		return false, false, nil, err
+	}
+
+	// "n" is acknowledged right away. result of the pull is reported to
+	// peer later, using "tc" or "tf" request
+	err = self.sendResult(msg, map[string]any{})
+	if err != nil {
+		self.endTransfer()
+		return false, false, nil, err
+	}
+
+	self.getMetrics().TransferStarted(false)
+
+	go func() {
+		defer self.endTransfer()
+
+		ctx := self.getTracer().Extract(context.Background(), trace_carrier)
+		ctx, span := self.getTracer().Start(ctx, "jrpcmux.receive")
+		span.SetAttribute("buffer_id", buffid_str)
+		span.SetAttribute("priority", priority.String())
+
+		write_seeker, digest, timedout, closed, proto_err, err :=
+			self.pullBuffer(ctx, buffid_str, priority, idle_expiry, transfer_limiter)
+
+		endSpan(span, timedout, closed, proto_err, err)
+
+		ok := !timedout && !closed && proto_err == nil && err == nil
+
+		self.getMetrics().TransferFinished(false, ok)
+
+		switch {
+		case reply_waiter != nil:
+			if ok {
+				reply_waiter.reply <- &transferReply{data: write_seeker}
+			} else {
+				if err == nil {
+					err = proto_err
+				}
+				if err == nil {
+					err = errors.New("timeout")
+				}
+				reply_waiter.reply <- &transferReply{err: err}
+			}
+		case !ok:
+		case wants_reply:
+			// transfer is confirmed first: sender's ReplyTimeout
+			// covers the time OnIncommingDataTransferReplyCB takes
+			self.reportTransferOutcome(buffid_str, digest, false, false, nil, nil)
+
+			reply, err := self.makeReply(write_seeker)
+			if err != nil {
+				// "tf" after "tc" fails sender's wait for reply
+				self.reportTransferOutcome(buffid_str, nil, false, false, nil, err)
+				return
+			}
+
+			self.sendReply(buffid_str, priority, reply)
+			return
+		default:
+			if self.debug {
+				self.DebugPrintln("go self.OnIncommingDataTransferComplete(write_seeker)")
+			}
+			go self.OnIncommingDataTransferComplete(write_seeker)
+		}
+
+		self.reportTransferOutcome(buffid_str, digest, timedout, closed, proto_err, err)
+	}()
+
+	return false, false, nil, nil
+}
+
+// pulls buffer announced by peer. returns received data and it's sha256 digest
+func (self *JSONRPC2DataStreamMultiplexer) pullBuffer(
+	ctx context.Context,
+	buffid_str string,
+	priority JSONRPC2DataStreamMultiplexerPriority,
+	idle_expiry time.Duration,
+	transfer_limiter *JSONRPC2DataStreamMultiplexerTokenBucket,
+) (
+	write_seeker io.WriteSeeker,
+	digest []byte,
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	self.setIncommingPriority(buffid_str, priority)
+	defer self.delIncommingPriority(buffid_str)
+
+	transfer := self.registerIncommingTransfer(buffid_str, priority)
+	defer self.unregisterIncommingTransfer(buffid_str)
+
 	var buffer_info_resp *JSONRPC2DataStreamMultiplexer_proto_BufferInfo_Res
 
 	{
+		_, span := self.getTracer().Start(ctx, "jrpcmux.gbi")
+		span.SetAttribute("buffer_id", buffid_str)
+
 		timedout, closed, buffer_info_resp, proto_err, err =
-			self.getBuffInfo(buffid_str, time.Minute)
+			self.getBuffInfo(buffid_str, 0, transfer.retried)
+
+		endSpan(span, timedout, closed, proto_err, err)
 
 		if proto_err != nil || err != nil {
-			return timedout, closed, proto_err, err
+			return nil, nil, timedout, closed, proto_err, err
 		}
 	}
 
@@ -299,6 +727,31 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(
 
 	buf_size := buffer_info_resp.Size
 
+	transfer.setSize(buf_size)
+
+	self.logger.Debug(
+		"pulling buffer",
+		"buffer_id", buffid_str,
+		"size", buf_size,
+		"priority", priority.String(),
+		"peer", self.GetPeerIdentity(),
+	)
+
+	if self.debug {
+		self.DebugPrintln("jrpcOnRequestCB_NEW_BUFFER_AVAILABLE: waiting for pull slot")
+	}
+
+	// peer forgets buffer, while it waits in queue, unless it's accessed
+	keepalive_done := make(chan struct{})
+	go self.keepBufferAlive(buffid_str, idle_expiry, keepalive_done)
+
+	pull, err := self.receive_scheduler.beginPull(buffid_str, priority, buf_size)
+	close(keepalive_done)
+	if err != nil {
+		return nil, nil, false, true, nil, err
+	}
+	defer self.receive_scheduler.endPull(pull)
+
 	var OnRequestToProvideWriteSeekerCB func(
 		size int64,
 		provide_data_destination func(io.WriteSeeker) error,
@@ -310,8 +763,6 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(
 		OnRequestToProvideWriteSeekerCB = self.OnRequestToProvideWriteSeekerCB
 	}
 
-	var write_seeker io.WriteSeeker
-
 	err = OnRequestToProvideWriteSeekerCB(
 		buf_size,
 		func(ws io.WriteSeeker) error {
@@ -329,92 +780,90 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(
 		},
 	)
 	if err != nil {
-		return false, false, nil, err
+		return nil, nil, false, false, nil, err
 	}
 
-	//result_buff := make([]byte, buf_size)
-
-	const slice_size = 1024 // to surely fit into MTU size
-
-	// buf_size_div_slice_size := buf_size / slice_size
-
-	//iterations_count := buf_size_div_slice_size
-	iterations_count := int64(buf_size / slice_size)
-	last_size := buf_size - (slice_size * iterations_count)
+	const slice_size = JSONRPC2_MULTIPLEXER_SLICE_SIZE
 
 	if self.debug {
 		self.DebugPrintfln("jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(%s)", buffid_str)
 		self.DebugPrintfln("   buffer_info_resp.Size = %d", buffer_info_resp.Size)
-		self.DebugPrintfln("   for i := 0; i != %d; i++ {", iterations_count)
-		self.DebugPrintfln("   last_size = %d", last_size)
-		// self.DebugPrintfln("   buf_size_div_slice_size = %d", buf_size_div_slice_size)
+		self.DebugPrintfln("   slice_size = %d", slice_size)
 	}
-	for i := int64(0); i != iterations_count; i++ {
 
-		buff_start := slice_size * i
-		buff_end := slice_size * (i + 1)
+	// slices are received in order, so digest is calculated on the way
+	hasher := sha256.New()
 
-		retry_countdown := 3
+	// retries of separate slice requests are made by
+	// requestSendingRespWaitingRoutine() according to RetryPolicy
+	for buff_start := int64(0); buff_start < buf_size; buff_start += slice_size {
 
-	retry_label2:
-		timedout, closed, proto_err, err := self.getBuffSlice(
-			write_seeker,
-			buffid_str,
-			buff_start,
-			buff_end,
-			time.Minute,
-		)
+		buff_end := buff_start + slice_size
+		if buff_end > buf_size {
+			buff_end = buf_size
+		}
 
-		if timedout || closed || proto_err != nil || err != nil {
-			if retry_countdown != 0 {
-				retry_countdown--
-				goto retry_label2
-			} else {
-				return timedout, closed, proto_err, err
-			}
+		if !self.getReceiveLimiter().WaitCancelable(buff_end-buff_start, self.closed_chan) ||
+			!transfer_limiter.WaitCancelable(buff_end-buff_start, self.closed_chan) {
+			return nil, nil, false, true, nil, ErrClosed
 		}
-	}
 
-	if self.debug {
-		self.DebugPrintln("	if last_size > 0 { :", last_size)
-	}
+		err = self.receive_scheduler.waitSliceTurn(pull)
+		if err != nil {
+			return nil, nil, false, true, nil, err
+		}
+		_, span := self.getTracer().Start(ctx, "jrpcmux.gbs")
+		span.SetAttribute("buffer_id", buffid_str)
+		span.SetAttribute("start", buff_start)
+		span.SetAttribute("end", buff_end)
 
-	if last_size > 0 {
-		buff_start := slice_size * iterations_count
-		buff_end := buff_start + last_size
-		retry_countdown := 3
+		transfer.setSlice(buff_start, buff_end)
 
-	retry_label3:
-		if self.debug {
-			self.DebugPrintln("retry_label3:")
-		}
+		slice_requested := time.Now()
 		timedout, closed, proto_err, err := self.getBuffSlice(
 			write_seeker,
 			buffid_str,
 			buff_start,
 			buff_end,
-			time.Minute,
+			hasher,
+			0,
+			// sender paces responses with same rate
+			pacingDelay(buff_end-buff_start, transfer_limiter.Rate()),
+			transfer.retried,
 		)
-		if self.debug {
-			self.DebugPrintln("getBuffSlice result:", timedout, closed, proto_err, err)
-		}
+		self.receive_scheduler.sliceDone(pull)
+
+		endSpan(span, timedout, closed, proto_err, err)
 
 		if timedout || closed || proto_err != nil || err != nil {
-			if retry_countdown != 0 {
-				retry_countdown--
-				goto retry_label3
-			} else {
-				return timedout, closed, proto_err, err
+			if self.debug {
+				self.DebugPrintln("getBuffSlice result:", timedout, closed, proto_err, err)
 			}
+			self.logger.Warn(
+				"can't get slice",
+				"buffer_id", buffid_str,
+				"start", buff_start,
+				"end", buff_end,
+				"timedout", timedout,
+				"closed", closed,
+				"proto_err", proto_err,
+				"err", err,
+			)
+			return nil, nil, timedout, closed, proto_err, err
 		}
-	}
 
-	if self.debug {
-		self.DebugPrintln("go self.OnIncommingDataTransferComplete(write_seeker)")
+		self.getMetrics().SliceLatency(time.Since(slice_requested))
+		transfer.received(buff_end - buff_start)
+
+		self.logger.Debug(
+			"slice received",
+			"buffer_id", buffid_str,
+			"start", buff_start,
+			"end", buff_end,
+		)
 	}
-	go self.OnIncommingDataTransferComplete(write_seeker)
 
-	return false, false, nil, nil
+	return write_seeker, hasher.Sum(nil), false, false, nil, nil
 }
 
 func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_INFO(msg *gojsonrpc2.Message) (
@@ -459,6 +908,12 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_INFO(msg *
 			errors.New("invalid buffer id")
 	}
 
+	if !self.isBufferReadAuthorized(bw) {
+		return false, false, nil, ErrBufferReadNotAuthorized
+	}
+
+	bw.touch(-1)
+
 	info := new(JSONRPC2DataStreamMultiplexer_proto_BufferInfo_Res)
 
 	{
@@ -490,6 +945,8 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_INFO(msg *
 	resp.Response.Result = info
 	resp.Error = nil
 
+	self.setResponsePriority(resp.Id, bw.Priority, false)
+
 	if self.debug {
 		self.DebugPrintln(
 			"jrpcOnRequestCB_GET_BUFFER_INFO: before SendResponse ",
@@ -600,7 +1057,11 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_SLICE(msg
 			errors.New("protocol error")
 	}
 
-	var buff_slice []byte
+	var (
+		buff_slice    []byte
+		buff_priority JSONRPC2DataStreamMultiplexerPriority
+		buff_limiter  *JSONRPC2DataStreamMultiplexerTokenBucket
+	)
 
 	timedout, closed, proto_err, err = func() (bool, bool, error, error) {
 		self.buffer_wrappers_mutex2.Lock()
@@ -614,6 +1075,13 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_SLICE(msg
 				errors.New("buffer not found")
 		}
 
+		if !self.isBufferReadAuthorized(buff) {
+			return false, false, nil, ErrBufferReadNotAuthorized
+		}
+
+		buff_priority = buff.Priority
+		buff_limiter = buff.limiter
+
 		buff_size, err := buff.BufferSize()
 		if err != nil {
 			return false, false, nil, err
@@ -633,8 +1101,18 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_SLICE(msg
 		if err != nil {
 			return false, false, nil, err
 		}
+
+		buff.touch(end)
+		buff.served(end - start)
+		self.logger.Debug(
+			"slice served",
+			"buffer_id", buffid_str,
+			"start", start,
+			"end", end,
+			"peer", self.GetPeerIdentity(),
+		)
 		if self.debug {
-			self.DebugPrintln("jrpcOnRequestCB_GET_BUFFER_SLICE. after BufferSlice:", buff_slice, err)
+			self.DebugPrintln("jrpcOnRequestCB_GET_BUFFER_SLICE. after BufferSlice:", len(buff_slice), err)
 		}
 		return false, false, nil, nil
 	}()
@@ -669,6 +1147,13 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GET_BUFFER_SLICE(msg
 	resp.Response.Result = resp_msg
 	resp.Error = nil
 
+	self.setResponsePriority(resp.Id, buff_priority, true)
+
+	// charged by data bytes (as receiver does), not by size of base64
+	if !buff_limiter.WaitCancelable(int64(len(buff_slice)), self.closed_chan) {
+		return false, true, nil, ErrClosed
+	}
+
 	if self.debug {
 		self.DebugPrintln(
 			"jrpcOnRequestCB_GET_BUFFER_SLICE: before SendResponse ",
@@ -709,6 +1194,13 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 
 	resp := new(gojsonrpc2.Message)
 
+	self.getMetrics().MessageIn(metricsMethod(msg.Method))
+	defer func() {
+		if proto_err != nil {
+			self.getMetrics().ProtocolError(metricsMethod(msg.Method))
+		}
+	}()
+
 	defer func() {
 		// TODO: add error handling?
 		if dont_send_default {
@@ -730,7 +1222,7 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 					err = err2
 					return
 				}
-				self.DebugPrintln("handle_jrpcOnRequestCB: sending response:", string(b))
+				self.DebugPrintln("handle_jrpcOnRequestCB: sending response:", msgSummary(resp), "size:", len(b))
 			}
 			err2 = self.jrpc_node.SendMessage(resp)
 			if err2 != nil {
@@ -755,6 +1247,30 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 	}
 
 	resp.Id = msg.Id
+
+	// "ac"/"ar" are the handshake itself. "pi" changes nothing and tells
+	// nothing, and keepalive must work while handshake is in progress
+	switch msg.Method {
+	case JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE,
+		JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO,
+		JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE,
+		JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE,
+		JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED,
+		JSONRPC2_MULTIPLEXER_METHOD_GOAWAY:
+		if !self.isPeerAuthenticated() {
+			if self.debug {
+				self.DebugPrintln(
+					"handle_jrpcOnRequestCB: rejecting request from not authenticated peer",
+				)
+			}
+			proto_err = ErrPeerNotAuthenticated
+			err = errors.New("protocol error")
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHENTICATED
+			resp.Error.Message = "not authenticated"
+			return
+		}
+	}
+
 	switch msg.Method {
 	default:
 		if self.debug {
@@ -762,7 +1278,7 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 		}
 		proto_err = errors.New("peer requested unsupported Method")
 		err = errors.New("protocol error")
-		resp.Error.Code = -32000
+		resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
 		resp.Error.Message = "protocol error"
 		return
 
@@ -776,9 +1292,13 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 		timedout, closed, proto_err, err =
 			self.jrpcOnRequestCB_NEW_BUFFER_AVAILABLE(msg)
 		if proto_err != nil {
-			resp.Error.Code = -32000
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
 			resp.Error.Message = "protocol error"
 		}
+		if errors.Is(err, ErrShuttingDown) {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_GOING_AWAY
+			resp.Error.Message = "going away"
+		}
 		if self.debug {
 			if proto_err != nil || err != nil {
 				self.DebugPrintln(
@@ -803,14 +1323,18 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 					" case JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO",
 			)
 		}
-		// TODO: reset timeout for
-		// JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE request
+		// resets inactivity timeout of
+		// JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE request (see touch())
 		timedout, closed, proto_err, err =
 			self.jrpcOnRequestCB_GET_BUFFER_INFO(msg)
 		if proto_err != nil {
-			resp.Error.Code = -32000
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
 			resp.Error.Message = "protocol error"
 		}
+		if errors.Is(err, ErrBufferReadNotAuthorized) {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHORIZED
+			resp.Error.Message = "not authorized"
+		}
 		if self.debug {
 			if proto_err != nil || err != nil {
 				self.DebugPrintln(
@@ -835,14 +1359,18 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 					" case JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE",
 			)
 		}
-		// TODO: reset timeout for
-		// JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE request
+		// resets inactivity timeout of
+		// JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE request (see touch())
 		timedout, closed, proto_err, err =
 			self.jrpcOnRequestCB_GET_BUFFER_SLICE(msg)
 		if proto_err != nil {
-			resp.Error.Code = -32000
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
 			resp.Error.Message = "protocol error"
 		}
+		if errors.Is(err, ErrBufferReadNotAuthorized) {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHORIZED
+			resp.Error.Message = "not authorized"
+		}
 		if self.debug {
 			if proto_err != nil || err != nil {
 				self.DebugPrintln(
@@ -853,6 +1381,114 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 			}
 		}
 
+		if proto_err != nil || err != nil {
+			return
+		} else {
+			dont_send_default = true
+			return
+		}
+
+	case JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE:
+		if self.debug {
+			self.DebugPrintln(
+				"handle_jrpcOnRequestCB:" +
+					" case JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE",
+			)
+		}
+		timedout, closed, proto_err, err =
+			self.jrpcOnRequestCB_AUTH_CHALLENGE(msg)
+		if proto_err != nil {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
+			resp.Error.Message = "protocol error"
+		}
+		if self.debug {
+			if proto_err != nil || err != nil {
+				self.DebugPrintln(
+					"handle_jrpcOnRequestCB "+
+						"(JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE):"+
+						" errors:", proto_err, ":", err,
+				)
+			}
+		}
+
+		if proto_err != nil || err != nil {
+			return
+		} else {
+			dont_send_default = true
+			return
+		}
+
+	case JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE:
+		if self.debug {
+			self.DebugPrintln(
+				"handle_jrpcOnRequestCB:" +
+					" case JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE",
+			)
+		}
+		timedout, closed, proto_err, err =
+			self.jrpcOnRequestCB_AUTH_RESPONSE(msg)
+		if proto_err != nil {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
+			resp.Error.Message = "protocol error"
+		}
+		if errors.Is(err, ErrPeerNotAuthenticated) {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHENTICATED
+			resp.Error.Message = "not authenticated"
+		}
+		if self.debug {
+			if proto_err != nil || err != nil {
+				self.DebugPrintln(
+					"handle_jrpcOnRequestCB "+
+						"(JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE):"+
+						" errors:", proto_err, ":", err,
+				)
+			}
+		}
+
+		if proto_err != nil || err != nil {
+			return
+		} else {
+			dont_send_default = true
+			return
+		}
+	case JSONRPC2_MULTIPLEXER_METHOD_GOAWAY:
+		timedout, closed, proto_err, err =
+			self.jrpcOnRequestCB_GOAWAY(msg)
+		if proto_err != nil || err != nil {
+			return
+		} else {
+			dont_send_default = true
+			return
+		}
+
+	case JSONRPC2_MULTIPLEXER_METHOD_PING:
+		timedout, closed, proto_err, err =
+			self.jrpcOnRequestCB_PING(msg)
+		if proto_err != nil || err != nil {
+			return
+		} else {
+			dont_send_default = true
+			return
+		}
+
+	case JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE,
+		JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED:
+		timedout, closed, proto_err, err =
+			self.jrpcOnRequestCB_TRANSFER_OUTCOME(msg)
+		if proto_err != nil {
+			resp.Error.Code = JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL
+			resp.Error.Message = "protocol error"
+		}
+		if self.debug {
+			if proto_err != nil || err != nil {
+				self.DebugPrintln(
+					"handle_jrpcOnRequestCB "+
+						"(JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_OUTCOME):"+
+						" errors:", proto_err, ":", err,
+				)
+			}
+		}
+
 		if proto_err != nil || err != nil {
 			return
 		} else {
@@ -863,6 +1499,8 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 
 }
 
+// timeout == 0 - derive from RetryPolicy and measured RTT
+//
 // results:
 // #0 bool - timedout
 // #1 bool - closed
@@ -872,12 +1510,13 @@ func (self *JSONRPC2DataStreamMultiplexer) handle_jrpcOnRequestCB(msg *gojsonrpc
 func (self *JSONRPC2DataStreamMultiplexer) getBuffInfo(
 	buffid string,
 	timeout time.Duration,
+	on_retry func(),
 ) (bool, bool, *JSONRPC2DataStreamMultiplexer_proto_BufferInfo_Res, error, error) {
 	m := new(gojsonrpc2.Message)
 	m.Method = JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO
 	m.Params = map[string]string{"id": buffid}
 	timedout, closed, resp, proto_eror, err :=
-		self.requestSendingRespWaitingRoutine(m, nil)
+		self.requestSendingRespWaitingRoutine(m, nil, timeout, 0, true, nil, on_retry)
 	if proto_eror != nil || err != nil {
 		return timedout, closed, nil, proto_eror, err
 	}
@@ -960,6 +1599,8 @@ func (self *JSONRPC2DataStreamMultiplexer) getBuffInfo(
 	return false, false, ret, nil, nil
 }
 
+// timeout == 0 - derive from RetryPolicy and measured RTT
+//
 // results:
 // #0 bool - timeout
 // #1 bool - closed
@@ -970,7 +1611,10 @@ func (self *JSONRPC2DataStreamMultiplexer) getBuffSlice(
 	buffid string,
 	buff_start int64,
 	buff_end int64,
+	digest hash.Hash,
 	timeout time.Duration,
+	pacing time.Duration,
+	on_retry func(),
 ) (
 	timedout bool,
 	closed bool,
@@ -1039,12 +1683,12 @@ func (self *JSONRPC2DataStreamMultiplexer) getBuffSlice(
 		}
 
 		timedout, closed, resp_msg, proto_eror, err =
-			self.requestSendingRespWaitingRoutine(m, nil)
+			self.requestSendingRespWaitingRoutine(m, nil, timeout, pacing, true, nil, on_retry)
 
 		if self.debug {
 			self.DebugPrintln(
 				"getBuffSlice: requestSendingRespWaitingRoutine result",
-				timedout, closed, resp_msg, proto_eror, err,
+				timedout, closed, msgSummary(resp_msg), proto_eror, err,
 			)
 		}
 
@@ -1102,15 +1746,57 @@ func (self *JSONRPC2DataStreamMultiplexer) getBuffSlice(
 			return false, false, nil, err
 		}
 
+		if digest != nil {
+			digest.Write(val_b)
+		}
+
+		return false, false, nil, nil
 	}
 
-	return false, false, nil, nil
+	return false, false, nil, fmt.Errorf("peer returned error: %s", resp_msg.Error.Message)
+}
+
+// send 'result' as successful response on request 'msg'
+func (self *JSONRPC2DataStreamMultiplexer) sendResult(
+	msg *gojsonrpc2.Message,
+	result any,
+) error {
+	resp := new(gojsonrpc2.Message)
+	{
+		x, ok := msg.GetId()
+		if !ok {
+			return errors.New("can't respond to notification")
+		}
+		err := resp.SetId(x)
+		if err != nil {
+			return err
+		}
+	}
+	resp.Response.Result = result
+	resp.Error = nil
+
+	return self.jrpc_node.SendResponse(resp)
 }
 
 func (self *JSONRPC2DataStreamMultiplexer) jrpcPushMessageToOutsideCB(data []byte) error {
 	if self.PushMessageToOutsideCB == nil {
 		panic("self.PushMessageToOutsideCB == nil")
 	}
+
+	priority, slice := self.outgoingMessagePriority(data)
+
+	// waiting for tokens isn't done inside gate, or slice waiting for them
+	// would hold back messages of higher priority
+	if slice && !self.getSendLimiter().WaitCancelable(int64(len(data)), self.closed_chan) {
+		return ErrClosed
+	}
+
+	self.outgoing_gate.Acquire(priority)
+	defer self.outgoing_gate.Release()
+
+	self.getMetrics().BytesSent(len(data))
+	self.record(JSONRPC2_MULTIPLEXER_RECORD_OUT, data)
+
 	return self.PushMessageToOutsideCB(data)
 }
 
@@ -1118,7 +1804,8 @@ func (self *JSONRPC2DataStreamMultiplexer) jrpcPushMessageToOutsideCB(data []byt
 //
 // NOTE: this function will not return until send succeed or fail. as a logical consecuance
 // to this, this function also returns the peer response via resp_msg
-// (NOTE: this response is Multiplexer protocol response, not a response on data youve sent via 'data')
+// (NOTE: this response is Multiplexer protocol response, not a response on data youve sent via 'data'.
+// use ChannelDataWithReply() to get application reply)
 func (self *JSONRPC2DataStreamMultiplexer) ChannelData(data []byte) (
 	timedout bool,
 	closed bool,
@@ -1126,6 +1813,9 @@ func (self *JSONRPC2DataStreamMultiplexer) ChannelData(data []byte) (
 	proto_err error,
 	err error,
 ) {
+	if self.isClosed() {
+		return false, true, nil, nil, ErrClosed
+	}
 	return self.ChannelDataReader(bytes.NewReader(data))
 }
 
@@ -1136,15 +1826,98 @@ func (self *JSONRPC2DataStreamMultiplexer) ChannelDataReader(data io.ReadSeeker)
 	proto_err error,
 	err error,
 ) {
+	return self.ChannelDataReaderWithOptions(data, nil)
+}
+
+// same as ChannelDataReader, but allows to tune transfer using 'options'.
+// 'options' may be nil
+func (self *JSONRPC2DataStreamMultiplexer) ChannelDataReaderWithOptions(
+	data io.ReadSeeker,
+	options *JSONRPC2DataStreamMultiplexerChannelDataOptions,
+) (
+	timedout bool,
+	closed bool,
+	resp_msg *gojsonrpc2.Message,
+	proto_err error,
+	err error,
+) {
+	var o JSONRPC2DataStreamMultiplexerChannelDataOptions
+	if options != nil {
+		o = *options
+	}
+	o.wants_reply = false
+	o.reply_to = ""
+
+	timedout, closed, resp_msg, _, proto_err, err = self.channelDataReader(data, &o)
+	return timedout, closed, resp_msg, proto_err, err
+}
+
+// reply is returned only if options.wants_reply is set
+func (self *JSONRPC2DataStreamMultiplexer) channelDataReader(
+	data io.ReadSeeker,
+	options *JSONRPC2DataStreamMultiplexerChannelDataOptions,
+) (
+	timedout bool,
+	closed bool,
+	resp_msg *gojsonrpc2.Message,
+	reply io.WriteSeeker,
+	proto_err error,
+	err error,
+) {
+
+	if self.isClosed() {
+		return false, true, nil, nil, nil, ErrClosed
+	}
+
+	if self.isPeerGoingAway() {
+		return false, false, nil, nil, nil, ErrPeerGoingAway
+	}
+
+	err = self.beginTransfer()
+	if err != nil {
+		return false, false, nil, nil, nil, err
+	}
+	defer self.endTransfer()
+
+	self.getMetrics().TransferStarted(true)
+	defer func() {
+		self.getMetrics().TransferFinished(
+			true,
+			!timedout && !closed && proto_err == nil && err == nil,
+		)
+	}()
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := self.getTracer().Start(ctx, "jrpcmux.send")
+	defer func() {
+		endSpan(span, timedout, closed, proto_err, err)
+	}()
 
 	if self.debug {
-		self.DebugPrintln("got data to channel:", data)
+		self.DebugPrintln("got data to channel")
 	}
 
 	var buffer_id string
 	var request_id any
 
 	wrapper := new(JSONRPC2DataStreamMultiplexerBufferWrapper)
+	wrapper.Buffer = data
+	wrapper.aborted = make(chan struct{})
+	wrapper.outcome = make(chan *gojsonrpc2.Message, 1)
+	wrapper.accepted = make(chan struct{})
+	if options.wants_reply {
+		wrapper.reply_started = make(chan struct{}, 1)
+		wrapper.reply = make(chan *transferReply, 1)
+		wrapper.reply_failed = make(chan *gojsonrpc2.Message, 1)
+	}
+
+	wrapper.size, err = wrapper.BufferSize()
+	if err != nil {
+		return false, false, nil, nil, nil, err
+	}
 
 	func() {
 		self.buffer_wrappers_mutex2.Lock()
@@ -1164,37 +1937,57 @@ func (self *JSONRPC2DataStreamMultiplexer) ChannelDataReader(data io.ReadSeeker)
 		}
 
 		wrapper.BufferId = buffer_id
-		wrapper.Buffer = data
+		wrapper.logger = self.logger
+		wrapper.Audience = options.Audience
+		wrapper.Priority = options.Priority.Normalize()
+		wrapper.limiter = NewJSONRPC2DataStreamMultiplexerTokenBucket(
+			options.RateLimit,
+			options.RateLimitBurst,
+		)
 
 		if self.debug {
 			self.DebugPrintln("saving buffer", buffer_id, "to wrapper")
 		}
-		self.buffer_wrappers = append(self.buffer_wrappers, wrapper)
+		self.registerBuffer(wrapper)
 	}()
 	if err != nil {
-		return false, false, nil, nil, err
+		return false, false, nil, nil, nil, err
 	}
 
 	defer func() {
-		self.buffer_wrappers_mutex2.Lock()
-		defer self.buffer_wrappers_mutex2.Unlock()
-
 		if self.debug {
 			self.DebugPrintln("cleaning up buffer", buffer_id, "wrapper")
 		}
 
-		for i := len(self.buffer_wrappers) - 1; i != -1; i += -1 {
-			if self.buffer_wrappers[i].BufferId == buffer_id {
-				self.buffer_wrappers = append(
-					self.buffer_wrappers[:i],
-					self.buffer_wrappers[i+1:]...,
-				)
-			}
-		}
+		self.unregisterBuffer(buffer_id)
 	}()
 
-	new_buffer_msg := new(JSONRPC2DataStreamMultiplexer_proto_NewBufferMsg)
+	idle_expiry := self.bufferIdleExpiry(options)
+
+	{
+		watch_done := make(chan struct{})
+		defer close(watch_done)
+		go self.watchBuffer(
+			wrapper,
+			idle_expiry,
+			JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT,
+			watch_done,
+		)
+	}
+
+	new_buffer_msg := new(JSONRPC2DataStreamMultiplexer_proto_NewBufferAvailable_Req)
 	new_buffer_msg.BufferId = buffer_id
+	new_buffer_msg.Priority = int(wrapper.Priority)
+	new_buffer_msg.RateLimit = wrapper.limiter.Rate()
+	new_buffer_msg.WantsReply = options.wants_reply
+	new_buffer_msg.ReplyTo = options.reply_to
+	new_buffer_msg.IdleExpiry = min(idle_expiry, JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT).Milliseconds()
+
+	self.injectTrace(ctx, new_buffer_msg)
+
+	span.SetAttribute("buffer_id", buffer_id)
+	span.SetAttribute("size", wrapper.size)
+	span.SetAttribute("priority", wrapper.Priority.String())
 
 	channel_start_msg := new(gojsonrpc2.Message)
 	channel_start_msg.Method = JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE
@@ -1225,40 +2018,109 @@ func (self *JSONRPC2DataStreamMultiplexer) ChannelDataReader(data io.ReadSeeker)
 		if self.debug {
 			self.DebugPrintln("new request id is:", request_id)
 		}
+		self.logger.Debug(
+			"announcing buffer",
+			"buffer_id", buffer_id,
+			"request_id", request_id,
+			"size", wrapper.size,
+			"priority", wrapper.Priority.String(),
+			"wants_reply", options.wants_reply,
+			"reply_to", options.reply_to,
+		)
 		if self.debug {
 			self.DebugPrintln("sending continue signal")
 		}
 		continue_chan <- struct{}{}
 	}()
 
+	// waiting for "n" response is stopped, if buffer is aborted or if peer
+	// already pulls it (so response is lost or late)
+	announce_cancel := make(chan struct{})
+	{
+		announce_done := make(chan struct{})
+		defer close(announce_done)
+		go func() {
+			select {
+			case <-wrapper.aborted:
+			case <-wrapper.accepted:
+			case <-announce_done:
+				return
+			}
+			close(announce_cancel)
+		}()
+	}
+
 	if self.debug {
 		self.DebugPrintln("sending new request")
 	}
 	timedout, closed, resp_msg, proto_err, err =
+		// not retried: re-announcing would start another pull
+		// of the same buffer on peer's side
 		self.requestSendingRespWaitingRoutine(
 			channel_start_msg,
 			hook,
+			0,
+			0,
+			false,
+			announce_cancel,
+			nil,
 		)
+	if errors.Is(err, errRequestCanceled) {
+		select {
+		case <-wrapper.aborted:
+			err = wrapper.abortErr()
+			timedout = errors.Is(err, ErrTransferTimeout)
+			return timedout, false, nil, nil, nil, err
+		default:
+		}
+
+		self.logger.Debug("\"n\" response not received, but peer pulls buffer", "buffer_id", buffer_id)
+
+		timedout, closed, resp_msg, proto_err, err = false, false, nil, nil, nil
+	}
 	if proto_err != nil || err != nil {
-		return false, false, nil, proto_err, err
+		return false, false, nil, nil, proto_err, err
 	}
 
 	if self.debug {
 		self.DebugPrintln(
 			"request sending results:",
-			timedout, closed, resp_msg, proto_err, err,
+			timedout, closed, msgSummary(resp_msg), proto_err, err,
 		)
 	}
 
-	return false, false, resp_msg, nil, nil
+	// timeout is handled by watchBuffer(), as inactivity timeout
+	timedout, closed, resp_msg, proto_err, err = self.waitTransferOutcome(wrapper)
+	if timedout || closed || proto_err != nil || err != nil {
+		return timedout, closed, nil, nil, proto_err, err
+	}
+
+	wrapper.setState(JSONRPC2_MULTIPLEXER_BUFFER_STATE_COMPLETED)
+
+	if options.wants_reply {
+		timedout, closed, reply, err = self.waitReply(wrapper, self.replyTimeout(options))
+		if timedout || closed || err != nil {
+			return timedout, closed, nil, nil, nil, err
+		}
+	}
+
+	return false, false, resp_msg, reply, nil, nil
 }
 
 // this have protocol restriction on input data size
 // #0 - protocol error
 // #1 - all errors
 func (self *JSONRPC2DataStreamMultiplexer) PushMessageFromOutside(data []byte) (error, error) {
-	if len(data) >= 1050 {
-		return errors.New("data is too big. must be < 1050"),
+	if self.isClosed() {
+		return nil, ErrClosed
+	}
+	self.getMetrics().BytesReceived(len(data))
+	self.record(JSONRPC2_MULTIPLEXER_RECORD_IN, data)
+	if len(data) >= JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE {
+		return fmt.Errorf(
+				"data is too big. must be < %d",
+				JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE,
+			),
 			errors.New("protocol error")
 	}
 	return self.jrpc_node.PushMessageFromOutside(data)
@@ -1323,6 +2185,35 @@ func DefaultOnRequestToProvideWriteSeekerCB(
 	return nil
 }
 
+// reads whole data received into WriteSeeker provided by
+// OnRequestToProvideWriteSeekerCB. it must also be io.ReadSeeker
+// (as InMemFile provided by DefaultOnRequestToProvideWriteSeekerCB is)
+func readWriteSeeker(ws io.WriteSeeker) ([]byte, error) {
+	rs, ok := ws.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("data destination (see OnRequestToProvideWriteSeekerCB) isn't readable")
+	}
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	// read in one go: io.ReadAll() doesn't work with goinmemfile
+	ret := make([]byte, size)
+	_, err = io.ReadFull(rs, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
 func getBuffIdFrom_msg_par(
 	msg_par map[string]any,
 ) (
@@ -0,0 +1,405 @@
+package gojsonrpc2datastreammultiplexer
+
+// optional handshake phase for JSONRPC2DataStreamMultiplexer.
+//
+// if JSONRPC2DataStreamMultiplexer.Authenticator is set, peer have to pass
+// challenge-response handshake (by calling Authenticate() on it's side) before
+// this side starts serving it's requests (n, gbi, gbs, tc, tf, ga). until
+// then, such requests are rejected with
+// JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHENTICATED error code. only
+// handshake itself and "pi" are served before it.
+//
+// handshake:
+//   - peer asks for challenge ("ac" request), this side generates it using
+//     Authenticator.NewChallenge() and remembers it;
+//   - peer computes response using it's Authenticator.Respond() and sends it
+//     with it's identity ("ar" request);
+//   - this side checks response with Authenticator.Verify() and, if it's ok,
+//     marks peer as authenticated.
+//
+// both sides run same handshake, so peer may try to reflect our own
+// response back to us. peer claiming our own identity is rejected, and
+// HMAC authenticator binds role of responding side into MAC: peers must
+// have different roles (for instance, connecting side is initiator and
+// accepting side is responder).
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE = "ac"
+	JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE  = "ar"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_ERROR_CODE_PROTOCOL          = -32000
+	JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHENTICATED = -32001
+	JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHORIZED    = -32002
+)
+
+var ErrPeerNotAuthenticated = errors.New("peer not authenticated")
+
+type JSONRPC2DataStreamMultiplexerAuthenticator interface {
+	// identity under which this side introduces itself to peer
+	Identity() string
+
+	// generate new challenge for peer
+	NewChallenge() ([]byte, error)
+
+	// compute response on challenge received from peer
+	Respond(challenge []byte) ([]byte, error)
+
+	// check peer's response on challenge previously made by NewChallenge()
+	Verify(identity string, challenge []byte, response []byte) (bool, error)
+}
+
+var _ JSONRPC2DataStreamMultiplexerAuthenticator = &JSONRPC2DataStreamMultiplexerHMACAuthenticator{}
+
+type JSONRPC2DataStreamMultiplexerAuthRole string
+
+const (
+	JSONRPC2_MULTIPLEXER_AUTH_ROLE_INITIATOR JSONRPC2DataStreamMultiplexerAuthRole = "initiator"
+	JSONRPC2_MULTIPLEXER_AUTH_ROLE_RESPONDER JSONRPC2DataStreamMultiplexerAuthRole = "responder"
+)
+
+func (self JSONRPC2DataStreamMultiplexerAuthRole) opposite() JSONRPC2DataStreamMultiplexerAuthRole {
+	if self == JSONRPC2_MULTIPLEXER_AUTH_ROLE_INITIATOR {
+		return JSONRPC2_MULTIPLEXER_AUTH_ROLE_RESPONDER
+	}
+	return JSONRPC2_MULTIPLEXER_AUTH_ROLE_INITIATOR
+}
+
+// HMAC-SHA256 challenge-response using secret shared by both sides.
+// responses are made for own role and expected from peer with opposite one,
+// so response can't be reflected back to side, which made it
+type JSONRPC2DataStreamMultiplexerHMACAuthenticator struct {
+	identity string
+	role     JSONRPC2DataStreamMultiplexerAuthRole
+	secret   []byte
+}
+
+func NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+	identity string,
+	role JSONRPC2DataStreamMultiplexerAuthRole,
+	secret []byte,
+) *JSONRPC2DataStreamMultiplexerHMACAuthenticator {
+	self := new(JSONRPC2DataStreamMultiplexerHMACAuthenticator)
+	self.identity = identity
+	self.role = role
+	self.secret = append([]byte{}, secret...)
+	return self
+}
+
+func (self *JSONRPC2DataStreamMultiplexerHMACAuthenticator) Identity() string {
+	return self.identity
+}
+
+func (self *JSONRPC2DataStreamMultiplexerHMACAuthenticator) NewChallenge() ([]byte, error) {
+	ret := make([]byte, 32)
+	_, err := rand.Read(ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexerHMACAuthenticator) Respond(challenge []byte) ([]byte, error) {
+	return self.mac(self.role, self.identity, challenge), nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexerHMACAuthenticator) Verify(
+	identity string,
+	challenge []byte,
+	response []byte,
+) (bool, error) {
+	return hmac.Equal(self.mac(self.role.opposite(), identity, challenge), response), nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexerHMACAuthenticator) mac(
+	role JSONRPC2DataStreamMultiplexerAuthRole,
+	identity string,
+	challenge []byte,
+) []byte {
+	h := hmac.New(sha256.New, self.secret)
+	h.Write([]byte(role))
+	h.Write([]byte{0})
+	h.Write([]byte(identity))
+	h.Write([]byte{0})
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// returns true if peer is allowed to use n/gbi/gbs methods
+func (self *JSONRPC2DataStreamMultiplexer) isPeerAuthenticated() bool {
+	if self.Authenticator == nil {
+		return true
+	}
+
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	return self.peer_authenticated
+}
+
+// identity peer introduced itself with during handshake.
+// empty if peer not authenticated (yet)
+func (self *JSONRPC2DataStreamMultiplexer) GetPeerIdentity() string {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	return self.peer_identity
+}
+
+// set peer identity explicitly. useful if peer is authenticated by other means
+// (for instance, by transport) and Authenticator isn't used
+func (self *JSONRPC2DataStreamMultiplexer) SetPeerIdentity(identity string) {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	self.peer_identity = identity
+}
+
+// pass handshake on peer's side, so peer will serve our requests.
+// self.Authenticator is used to compute response for peer's challenge.
+func (self *JSONRPC2DataStreamMultiplexer) Authenticate() (
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	if self.isClosed() {
+		return false, true, nil, ErrClosed
+	}
+
+	if self.Authenticator == nil {
+		return false, false, nil, errors.New("Authenticator not set")
+	}
+
+	if self.debug {
+		self.DebugPrintln("Authenticate: asking peer for challenge")
+	}
+
+	var challenge []byte
+
+	{
+		m := new(gojsonrpc2.Message)
+		m.Method = JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE
+		m.Params = map[string]any{}
+
+		timedout, closed, resp, proto_err, err :=
+			self.requestSendingRespWaitingRoutine(m, nil, 0, 0, true, nil, nil)
+		if proto_err != nil || err != nil {
+			return timedout, closed, proto_err, err
+		}
+
+		if resp.IsError() {
+			return false, false, nil, errors.New("peer refused to issue challenge")
+		}
+
+		resp_map, ok := resp.Result.(map[string]any)
+		if !ok {
+			return false,
+				false,
+				errors.New("can't use challenge response as object"),
+				errors.New("protocol error")
+		}
+
+		c_str, ok := resp_map["c"].(string)
+		if !ok {
+			return false,
+				false,
+				errors.New("can't get 'c' string from json object"),
+				errors.New("protocol error")
+		}
+
+		challenge, err = base64.RawStdEncoding.DecodeString(c_str)
+		if err != nil {
+			return false, false, err, errors.New("protocol error")
+		}
+	}
+
+	response, err := self.Authenticator.Respond(challenge)
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	if self.debug {
+		self.DebugPrintln("Authenticate: sending response on challenge")
+	}
+
+	m := new(gojsonrpc2.Message)
+	m.Method = JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE
+	m.Params = &JSONRPC2DataStreamMultiplexer_proto_AuthResponse_Req{
+		Identity: self.Authenticator.Identity(),
+		Response: base64.RawStdEncoding.EncodeToString(response),
+	}
+
+	timedout, closed, resp, proto_err, err :=
+		self.requestSendingRespWaitingRoutine(m, nil, 0, 0, true, nil, nil)
+	if proto_err != nil || err != nil {
+		return timedout, closed, proto_err, err
+	}
+
+	if resp.IsError() {
+		return false, false, nil, ErrPeerNotAuthenticated
+	}
+
+	return false, false, nil, nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_AUTH_CHALLENGE(msg *gojsonrpc2.Message) (
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	if self.debug {
+		self.DebugPrintln("jrpcOnRequestCB_AUTH_CHALLENGE")
+	}
+
+	if self.Authenticator == nil {
+		return false,
+			false,
+			errors.New("peer requested challenge, but Authenticator not set"),
+			errors.New("protocol error")
+	}
+
+	challenge, err := self.Authenticator.NewChallenge()
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	func() {
+		self.auth_mutex.Lock()
+		defer self.auth_mutex.Unlock()
+		self.auth_challenge = challenge
+	}()
+
+	res := new(JSONRPC2DataStreamMultiplexer_proto_AuthChallenge_Res)
+	res.Challenge = base64.RawStdEncoding.EncodeToString(challenge)
+
+	err = self.sendResult(msg, res)
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	return false, false, nil, nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_AUTH_RESPONSE(msg *gojsonrpc2.Message) (
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	if self.debug {
+		self.DebugPrintln("jrpcOnRequestCB_AUTH_RESPONSE")
+	}
+
+	if self.Authenticator == nil {
+		return false,
+			false,
+			errors.New("peer sent challenge response, but Authenticator not set"),
+			errors.New("protocol error")
+	}
+
+	msg_par, ok := (msg.Params).(map[string]any)
+	if !ok {
+		return false,
+			false,
+			errors.New("can't convert msg.Params to map[string]string"),
+			errors.New("protocol error")
+	}
+
+	identity, ok := msg_par["i"].(string)
+	if !ok {
+		return false,
+			false,
+			errors.New("'i' parameter required, but not found"),
+			errors.New("protocol error")
+	}
+
+	r_str, ok := msg_par["r"].(string)
+	if !ok {
+		return false,
+			false,
+			errors.New("'r' parameter required, but not found"),
+			errors.New("protocol error")
+	}
+
+	response, err := base64.RawStdEncoding.DecodeString(r_str)
+	if err != nil {
+		return false, false, err, errors.New("protocol error")
+	}
+
+	var challenge []byte
+
+	func() {
+		self.auth_mutex.Lock()
+		defer self.auth_mutex.Unlock()
+		// challenge can be used only once
+		challenge = self.auth_challenge
+		self.auth_challenge = nil
+	}()
+
+	if challenge == nil {
+		return false,
+			false,
+			errors.New("peer sent challenge response without asking for challenge"),
+			ErrPeerNotAuthenticated
+	}
+
+	if identity == self.Authenticator.Identity() {
+		// reflection of our own response
+		self.logger.Warn("peer claimed our own identity", "peer", identity)
+		return false,
+			false,
+			errors.New("peer claimed our own identity"),
+			ErrPeerNotAuthenticated
+	}
+
+	ok, err = self.Authenticator.Verify(identity, challenge, response)
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	if !ok {
+		if self.debug {
+			self.DebugPrintln("jrpcOnRequestCB_AUTH_RESPONSE: peer failed verification:", identity)
+		}
+		self.logger.Warn("peer failed authentication", "peer", identity)
+		return false,
+			false,
+			errors.New("invalid challenge response"),
+			ErrPeerNotAuthenticated
+	}
+
+	func() {
+		self.auth_mutex.Lock()
+		defer self.auth_mutex.Unlock()
+		self.peer_authenticated = true
+		self.peer_identity = identity
+	}()
+
+	if self.debug {
+		self.DebugPrintln("jrpcOnRequestCB_AUTH_RESPONSE: peer authenticated as", identity)
+	}
+	self.logger.Info("peer authenticated", "peer", identity)
+
+	res := new(JSONRPC2DataStreamMultiplexer_proto_AuthResponse_Res)
+	res.Ok = true
+
+	err = self.sendResult(msg, res)
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	return false, false, nil, nil
+}
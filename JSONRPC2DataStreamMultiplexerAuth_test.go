@@ -0,0 +1,197 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+)
+
+var test_auth_secret = []byte("test secret")
+
+func TestHMACAuthenticatorRoles(t *testing.T) {
+	a := NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+		"a", JSONRPC2_MULTIPLEXER_AUTH_ROLE_INITIATOR, test_auth_secret,
+	)
+	b := NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+		"b", JSONRPC2_MULTIPLEXER_AUTH_ROLE_RESPONDER, test_auth_secret,
+	)
+
+	challenge, err := b.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := a.Respond(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, _ := b.Verify("a", challenge, response)
+	if !ok {
+		t.Fatal("response of initiator rejected by responder")
+	}
+
+	// response is bound to role of side, which made it
+	ok, _ = a.Verify("a", challenge, response)
+	if ok {
+		t.Fatal("response accepted by side with same role")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	p.A.Authenticator = NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+		"a", JSONRPC2_MULTIPLEXER_AUTH_ROLE_INITIATOR, test_auth_secret,
+	)
+	p.B.Authenticator = NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+		"b", JSONRPC2_MULTIPLEXER_AUTH_ROLE_RESPONDER, test_auth_secret,
+	)
+
+	_, _, proto_err, err := p.A.Authenticate()
+	if proto_err != nil || err != nil {
+		t.Fatal(proto_err, err)
+	}
+
+	_, _, proto_err, err = p.B.Authenticate()
+	if proto_err != nil || err != nil {
+		t.Fatal(proto_err, err)
+	}
+
+	if p.B.GetPeerIdentity() != "a" || p.A.GetPeerIdentity() != "b" {
+		t.Fatal("wrong peer identities:", p.B.GetPeerIdentity(), p.A.GetPeerIdentity())
+	}
+}
+
+// attacker without secret: gets victim's challenge, makes victim answer it
+// as challenge of attacker and sends victim's answer back, claiming
+// victim's identity
+type reflectingAuthenticator struct {
+	victim   *JSONRPC2DataStreamMultiplexer
+	identity string
+
+	mutex     sync.Mutex
+	challenge []byte
+	response  []byte
+}
+
+func (self *reflectingAuthenticator) Identity() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// until victim answered, victim's "ar" must pass our own identity check
+	if self.response == nil {
+		return "attacker"
+	}
+	return self.identity
+}
+
+func (self *reflectingAuthenticator) NewChallenge() ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.challenge, nil
+}
+
+func (self *reflectingAuthenticator) Respond(challenge []byte) ([]byte, error) {
+	self.mutex.Lock()
+	self.challenge = challenge
+	self.mutex.Unlock()
+
+	// victim asks for challenge and gets its own one
+	self.victim.Authenticate()
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.response, nil
+}
+
+func (self *reflectingAuthenticator) Verify(
+	identity string,
+	challenge []byte,
+	response []byte,
+) (bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.response = response
+	return false, nil
+}
+
+func TestAuthenticateReflectedResponse(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	attacker := &reflectingAuthenticator{victim: p.B, identity: "b"}
+
+	p.A.Authenticator = attacker
+	p.B.Authenticator = NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+		"b", JSONRPC2_MULTIPLEXER_AUTH_ROLE_RESPONDER, test_auth_secret,
+	)
+
+	_, _, proto_err, err := p.A.Authenticate()
+	if !errors.Is(proto_err, ErrPeerNotAuthenticated) &&
+		!errors.Is(err, ErrPeerNotAuthenticated) {
+		t.Fatal("expected ErrPeerNotAuthenticated, got", proto_err, err)
+	}
+
+	if p.B.isPeerAuthenticated() {
+		t.Fatal("attacker authenticated with reflected response")
+	}
+
+	attacker.mutex.Lock()
+	defer attacker.mutex.Unlock()
+
+	if attacker.response == nil {
+		t.Fatal("victim didn't answer reflected challenge")
+	}
+
+	// identity check alone is enough: role binding must stop it too
+	ok, _ := p.B.Authenticator.Verify("b", attacker.challenge, attacker.response)
+	if ok {
+		t.Fatal("reflected response passes HMAC verification")
+	}
+}
+
+// "ga" from not authenticated peer must not make ChannelData* fail
+func TestGoAwayRequiresAuthentication(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	p.B.Authenticator = NewJSONRPC2DataStreamMultiplexerHMACAuthenticator(
+		"b", JSONRPC2_MULTIPLEXER_AUTH_ROLE_RESPONDER, test_auth_secret,
+	)
+
+	responses := make(chan []byte, 1)
+	p.B.PushMessageToOutsideCB = func(data []byte) error {
+		responses <- append([]byte(nil), data...)
+		return nil
+	}
+
+	proto_err, _ := p.B.PushMessageFromOutside(
+		[]byte(`{"jsonrpc":"2.0","id":"x1","method":"ga","params":{}}`),
+	)
+	if !errors.Is(proto_err, ErrPeerNotAuthenticated) {
+		t.Fatal("expected ErrPeerNotAuthenticated, got", proto_err)
+	}
+
+	var resp struct {
+		Error *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	err := json.Unmarshal(<-responses, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || resp.Error.Code != JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHENTICATED {
+		t.Fatal("expected NOT_AUTHENTICATED error, got", resp.Error)
+	}
+
+	if p.B.isPeerGoingAway() {
+		t.Fatal("not authenticated peer marked as going away")
+	}
+}
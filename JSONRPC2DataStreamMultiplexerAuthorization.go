@@ -0,0 +1,44 @@
+package gojsonrpc2datastreammultiplexer
+
+// per-peer authorization of buffer reads.
+//
+// buffer can be tagged with Audience (see
+// JSONRPC2DataStreamMultiplexerChannelDataOptions). on every gbi/gbs request
+// JSONRPC2DataStreamMultiplexer.OnAuthorizeBufferReadCB is consulted, and if
+// it's nil - buffer with not empty Audience is served only to peer with
+// identity equal to Audience. peer identity is obtained from handshake
+// (see JSONRPC2DataStreamMultiplexerAuth.go) or set using SetPeerIdentity().
+
+import "errors"
+
+var ErrBufferReadNotAuthorized = errors.New("peer not authorized to read buffer")
+
+func DefaultOnAuthorizeBufferReadCB(
+	peer_identity string,
+	bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
+) bool {
+	if bw.Audience == "" {
+		return true
+	}
+	return bw.Audience == peer_identity
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) isBufferReadAuthorized(
+	bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
+) bool {
+	cb := self.OnAuthorizeBufferReadCB
+	if cb == nil {
+		cb = DefaultOnAuthorizeBufferReadCB
+	}
+
+	ret := cb(self.GetPeerIdentity(), bw)
+
+	if !ret && self.debug {
+		self.DebugPrintln(
+			"peer", self.GetPeerIdentity(),
+			"not authorized to read buffer", bw.BufferId,
+		)
+	}
+
+	return ret
+}
@@ -0,0 +1,173 @@
+package gojsonrpc2datastreammultiplexer
+
+// expiry of buffers, which peer doesn't pull, and inactivity timeout of
+// transfers.
+//
+// if peer doesn't issue gbi/gbs for announced buffer (or stops doing it
+// halfway) for longer than idle expiry, buffer is marked as expired and
+// unregistered, and ChannelDataReader* call fails with ErrBufferExpired.
+// completely read buffers don't expire.
+//
+// idle expiry is taken from JSONRPC2DataStreamMultiplexerChannelDataOptions.IdleExpiry,
+// then from JSONRPC2DataStreamMultiplexer.BufferIdleExpiry, then
+// JSONRPC2_MULTIPLEXER_BUFFER_IDLE_EXPIRY is used.
+//
+// sender's wait for transfer outcome ("tc"/"tf" request) has no fixed
+// timeout: it's JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT since last gbi/gbs
+// of the buffer, so transfers of any length succeed, while slices are flowing.
+//
+// sender tells lesser of the two in "n" ('x', milliseconds). receiver's
+// pulls can wait in receive scheduler's queue for longer than that, so
+// receiver keeps queued buffers alive with gbi requests.
+
+import (
+	"errors"
+	"time"
+)
+
+const JSONRPC2_MULTIPLEXER_BUFFER_IDLE_EXPIRY = time.Minute
+
+var (
+	ErrBufferExpired   = errors.New("buffer expired: peer didn't access it for too long")
+	ErrTransferTimeout = errors.New("timeout: no transfer activity from peer")
+)
+
+// internal: returned by requestSendingRespWaitingRoutine, if waiting is canceled
+var errRequestCanceled = errors.New("request canceled")
+
+func (self *JSONRPC2DataStreamMultiplexer) bufferIdleExpiry(
+	options *JSONRPC2DataStreamMultiplexerChannelDataOptions,
+) time.Duration {
+	if options != nil && options.IdleExpiry > 0 {
+		return options.IdleExpiry
+	}
+	if self.BufferIdleExpiry > 0 {
+		return self.BufferIdleExpiry
+	}
+	return JSONRPC2_MULTIPLEXER_BUFFER_IDLE_EXPIRY
+}
+
+// sends gbi for buffer of peer every third of idle_expiry, until done is
+// closed
+func (self *JSONRPC2DataStreamMultiplexer) keepBufferAlive(
+	buffid string,
+	idle_expiry time.Duration,
+	done <-chan struct{},
+) {
+	interval := idle_expiry / 3
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-self.closed_chan:
+			return
+		case <-ticker.C:
+		}
+
+		if self.debug {
+			self.DebugPrintln("keeping queued buffer", buffid, "alive")
+		}
+
+		timedout, closed, _, proto_err, err := self.getBuffInfo(buffid, 0, nil)
+		if timedout || closed || proto_err != nil || err != nil {
+			self.logger.Debug(
+				"can't keep queued buffer alive",
+				"buffer_id", buffid,
+				"timedout", timedout,
+				"closed", closed,
+				"proto_err", proto_err,
+				"err", err,
+			)
+		}
+	}
+}
+
+// returns time passed since last access to buffer by peer
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) idle() time.Duration {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	return time.Since(self.last_access)
+}
+
+// closes bw.aborted. err is returned later by abortErr()
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) abort(err error) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	self.abort_err = err
+	close(self.aborted)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) abortErr() error {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	return self.abort_err
+}
+
+// watches buffer until 'done' is closed. if buffer expires, it's
+// unregistered and aborted with ErrBufferExpired. if buffer isn't accessed
+// for 'inactivity_timeout', it's aborted with ErrTransferTimeout
+func (self *JSONRPC2DataStreamMultiplexer) watchBuffer(
+	bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
+	expiry time.Duration,
+	inactivity_timeout time.Duration,
+	done <-chan struct{},
+) {
+	first := inactivity_timeout
+	if expiry < first {
+		first = expiry
+	}
+
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		idle := bw.idle()
+		completed := bw.State() == JSONRPC2_MULTIPLEXER_BUFFER_STATE_COMPLETED
+
+		if !completed && idle >= expiry {
+			if self.debug {
+				self.DebugPrintln("buffer", bw.BufferId, "expired. idle for", idle)
+			}
+
+			self.logger.Warn("buffer expired", "buffer_id", bw.BufferId, "idle", idle)
+
+			bw.setState(JSONRPC2_MULTIPLEXER_BUFFER_STATE_EXPIRED)
+			self.unregisterBuffer(bw.BufferId)
+			bw.abort(ErrBufferExpired)
+			return
+		}
+
+		if idle >= inactivity_timeout {
+			if self.debug {
+				self.DebugPrintln("buffer", bw.BufferId, "transfer timed out. idle for", idle)
+			}
+
+			self.logger.Warn("transfer timed out", "buffer_id", bw.BufferId, "idle", idle)
+
+			bw.abort(ErrTransferTimeout)
+			return
+		}
+
+		next := inactivity_timeout - idle
+		if !completed && expiry-idle < next {
+			next = expiry - idle
+		}
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,131 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testData(size int, seed byte) []byte {
+	ret := make([]byte, size)
+	for i := range ret {
+		ret[i] = byte(i)*7 + seed
+	}
+	return ret
+}
+
+func readAllWriteSeeker(t *testing.T, ws io.WriteSeeker) []byte {
+	rs := ws.(io.ReadSeeker)
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	ret := make([]byte, size)
+	_, err = io.ReadFull(rs, ret)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	return ret
+}
+
+// fails test, if wg isn't done in time
+func waitGroupTimeout(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		t.Error("timed out waiting")
+		return false
+	}
+}
+
+// pulls, waiting in receive scheduler's queue for longer than sender's idle
+// expiry, must not let buffers expire
+func TestQueuedPullsKeepBuffersAlive(t *testing.T) {
+	const (
+		transfers   = 6
+		idle_expiry = 150 * time.Millisecond
+	)
+
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{Latency: 5 * time.Millisecond},
+	)
+	defer p.Close()
+
+	p.A.BufferIdleExpiry = idle_expiry
+
+	// one pull at a time: last transfer waits for all others
+	p.B.GetReceiveScheduler().SetLimits(1, 1)
+
+	var (
+		received_mutex sync.Mutex
+		received       [][]byte
+		received_wg    sync.WaitGroup
+	)
+	received_wg.Add(transfers)
+
+	p.B.OnIncommingDataTransferComplete = func(ws io.WriteSeeker) {
+		defer received_wg.Done()
+
+		received_mutex.Lock()
+		defer received_mutex.Unlock()
+
+		received = append(received, readAllWriteSeeker(t, ws))
+	}
+
+	started := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i != transfers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			timedout, closed, _, proto_err, err := p.A.ChannelData(testData(4096, byte(i)))
+			if timedout || closed || proto_err != nil || err != nil {
+				t.Errorf("transfer %d: %v %v %v %v", i, timedout, closed, proto_err, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if !waitGroupTimeout(t, &received_wg, 10*time.Second) {
+		t.FailNow()
+	}
+
+	if time.Since(started) < 2*idle_expiry {
+		t.Fatal("transfers were too fast to wait in queue for longer than idle expiry")
+	}
+
+	for i := 0; i != transfers; i++ {
+		expected := testData(4096, byte(i))
+		found := false
+		for _, r := range received {
+			if bytes.Equal(r, expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("data of transfer %d not received", i)
+		}
+	}
+}
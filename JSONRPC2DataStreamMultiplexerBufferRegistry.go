@@ -0,0 +1,167 @@
+package gojsonrpc2datastreammultiplexer
+
+// registry of buffers, announced by this side (outgoing transfers).
+//
+// buffers are stored in map by BufferId. each buffer has lifecycle state,
+// creation and last access time. BufferRegistrySnapshot() returns read-only
+// copy of registry for inspection.
+
+import (
+	"time"
+)
+
+type JSONRPC2DataStreamMultiplexerBufferState int
+
+const (
+	// announced to peer, but peer didn't touch it yet
+	JSONRPC2_MULTIPLEXER_BUFFER_STATE_ANNOUNCED JSONRPC2DataStreamMultiplexerBufferState = iota
+	// peer requested info or slices
+	JSONRPC2_MULTIPLEXER_BUFFER_STATE_BEING_READ
+	// peer got all of the buffer
+	JSONRPC2_MULTIPLEXER_BUFFER_STATE_COMPLETED
+	// peer didn't access buffer for too long
+	JSONRPC2_MULTIPLEXER_BUFFER_STATE_EXPIRED
+)
+
+func (self JSONRPC2DataStreamMultiplexerBufferState) String() string {
+	switch self {
+	case JSONRPC2_MULTIPLEXER_BUFFER_STATE_ANNOUNCED:
+		return "announced"
+	case JSONRPC2_MULTIPLEXER_BUFFER_STATE_BEING_READ:
+		return "being read"
+	case JSONRPC2_MULTIPLEXER_BUFFER_STATE_COMPLETED:
+		return "completed"
+	case JSONRPC2_MULTIPLEXER_BUFFER_STATE_EXPIRED:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+type JSONRPC2DataStreamMultiplexerBufferSnapshot struct {
+	BufferId   string
+	RequestId  any
+	Audience   string
+	Priority   JSONRPC2DataStreamMultiplexerPriority
+	Size       int64
+	State      JSONRPC2DataStreamMultiplexerBufferState
+	Created    time.Time
+	LastAccess time.Time
+	// bytes sent to peer in gbs responses. retried slices are counted again
+	BytesServed int64
+	// time since Created, at the moment of snapshot
+	Age time.Duration
+}
+
+// no re-entrant locks in golang
+func (self *JSONRPC2DataStreamMultiplexer) getBuffByIdLocal(id string) (
+	bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
+	ok bool,
+) {
+	self.buffer_wrappers_mutex2.Lock()
+	defer self.buffer_wrappers_mutex2.Unlock()
+
+	bw, ok = self.buffer_wrappers[id]
+	return bw, ok
+}
+
+// must be called with buffer_wrappers_mutex2 locked
+func (self *JSONRPC2DataStreamMultiplexer) registerBuffer(
+	bw *JSONRPC2DataStreamMultiplexerBufferWrapper,
+) {
+	now := time.Now()
+
+	bw.Mutex.Lock()
+	bw.state = JSONRPC2_MULTIPLEXER_BUFFER_STATE_ANNOUNCED
+	bw.created = now
+	bw.last_access = now
+	bw.Mutex.Unlock()
+
+	self.buffer_wrappers[bw.BufferId] = bw
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) unregisterBuffer(id string) {
+	self.buffer_wrappers_mutex2.Lock()
+	defer self.buffer_wrappers_mutex2.Unlock()
+
+	delete(self.buffer_wrappers, id)
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) BufferRegistrySnapshot() []JSONRPC2DataStreamMultiplexerBufferSnapshot {
+	self.buffer_wrappers_mutex2.Lock()
+	defer self.buffer_wrappers_mutex2.Unlock()
+
+	ret := make([]JSONRPC2DataStreamMultiplexerBufferSnapshot, 0, len(self.buffer_wrappers))
+
+	for _, bw := range self.buffer_wrappers {
+		ret = append(ret, bw.snapshot())
+	}
+
+	return ret
+}
+
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) snapshot() JSONRPC2DataStreamMultiplexerBufferSnapshot {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	return JSONRPC2DataStreamMultiplexerBufferSnapshot{
+		BufferId:    self.BufferId,
+		RequestId:   self.RequestId,
+		Audience:    self.Audience,
+		Priority:    self.Priority,
+		Size:        self.size,
+		State:       self.state,
+		Created:     self.created,
+		LastAccess:  self.last_access,
+		BytesServed: self.bytes_served,
+		Age:         time.Since(self.created),
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) served(size int64) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	self.bytes_served += size
+}
+
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) State() JSONRPC2DataStreamMultiplexerBufferState {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	return self.state
+}
+
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) setState(
+	state JSONRPC2DataStreamMultiplexerBufferState,
+) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	self.state = state
+}
+
+// peer accessed buffer. 'end' - end of slice served to peer (-1 for gbi)
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) touch(end int64) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	self.last_access = time.Now()
+
+	self.accept()
+
+	switch self.state {
+	case JSONRPC2_MULTIPLEXER_BUFFER_STATE_ANNOUNCED,
+		JSONRPC2_MULTIPLEXER_BUFFER_STATE_BEING_READ:
+		if end == self.size {
+			self.state = JSONRPC2_MULTIPLEXER_BUFFER_STATE_COMPLETED
+		} else {
+			self.state = JSONRPC2_MULTIPLEXER_BUFFER_STATE_BEING_READ
+		}
+	}
+}
+
+// peer got "n" request. see bw.accepted
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) accept() {
+	self.accepted_once.Do(func() { close(self.accepted) })
+}
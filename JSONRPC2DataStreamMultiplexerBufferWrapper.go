@@ -1,19 +1,58 @@
 package gojsonrpc2datastreammultiplexer
 
 import (
+	"crypto/sha256"
 	"errors"
-	"fmt"
 	"io"
+	"log/slog"
 	"sync"
+	"time"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
 )
 
 type JSONRPC2DataStreamMultiplexerBufferWrapper struct {
 	BufferId  string
 	RequestId any
 	Buffer    io.ReadSeeker
+	// identity of peer this buffer is announced to. empty - any peer
+	Audience string
+	Priority JSONRPC2DataStreamMultiplexerPriority
+	limiter  *JSONRPC2DataStreamMultiplexerTokenBucket
+
+	// see JSONRPC2DataStreamMultiplexerBufferRegistry.go.
+	// protected by Mutex
+	size         int64
+	state        JSONRPC2DataStreamMultiplexerBufferState
+	created      time.Time
+	last_access  time.Time
+	bytes_served int64
+
+	// closed when buffer expires or transfer times out. abort_err tells why.
+	// see JSONRPC2DataStreamMultiplexerBufferExpiry.go
+	aborted   chan struct{}
+	abort_err error
+
+	// receives first "tc"/"tf" request from peer. protected by Mutex
+	outcome     chan *gojsonrpc2.Message
+	got_outcome bool
+
+	// closed when peer starts pulling buffer or reports outcome: peer got
+	// "n" request, even if it's response is lost
+	accepted      chan struct{}
+	accepted_once sync.Once
+
+	// not nil, if buffer waits for reply. see JSONRPC2DataStreamMultiplexerReply.go
+	reply_started chan struct{}
+	reply         chan *transferReply
+	// "tf" after "tc": peer failed to make reply
+	reply_failed chan *gojsonrpc2.Message
+
 	Mutex     sync.Mutex
 	debugName string
 	debug     bool
+	// nil - nothing is logged. see JSONRPC2DataStreamMultiplexerLog.go
+	logger *slog.Logger
 }
 
 func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) SetDebugName(name string) {
@@ -21,7 +60,14 @@ func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) SetDebugName(name string
 }
 
 func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) DebugPrintln(data ...any) {
-	fmt.Println(append(append([]any{}, self.debugName), data...)...)
+	if self.logger == nil {
+		return
+	}
+	self.logger.Debug(
+		debugSprintln(data...),
+		"wrapper", self.debugName,
+		"buffer_id", self.BufferId,
+	)
 }
 
 func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) BufferSize() (int64, error) {
@@ -34,6 +80,25 @@ func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) intBufferSize() (int64,
 	return self.Buffer.Seek(0, io.SeekEnd)
 }
 
+// sha256 of whole buffer
+func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) BufferDigest() ([]byte, error) {
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	_, err := self.Buffer.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, self.Buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
 func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) BufferSlice(start int64, end int64) (ret_bytes []byte, ret_err error) {
 	self.Mutex.Lock()
 	defer self.Mutex.Unlock()
@@ -48,7 +113,7 @@ func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) intBufferSlice(start int
 
 	defer func() {
 		if self.debug {
-			self.DebugPrintln("BufferSlice defer", ret_bytes, ret_err)
+			self.DebugPrintln("BufferSlice defer", len(ret_bytes), ret_err)
 		}
 	}()
 
@@ -83,7 +148,7 @@ func (self *JSONRPC2DataStreamMultiplexerBufferWrapper) intBufferSlice(start int
 	x := make([]byte, end-start)
 
 	if self.debug {
-		self.DebugPrintln("io.ReadFull(self.Buffer, ", x, ")")
+		self.DebugPrintln("io.ReadFull(self.Buffer, ", len(x), ")")
 	}
 	_, err = io.ReadFull(self.Buffer, x)
 	if err != nil {
@@ -0,0 +1,42 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"context"
+	"time"
+)
+
+// per-transfer settings for ChannelDataReaderWithOptions()
+type JSONRPC2DataStreamMultiplexerChannelDataOptions struct {
+	// identity of peer allowed to read the buffer. empty - any peer.
+	// see JSONRPC2DataStreamMultiplexerAuthorization.go
+	Audience string
+
+	// priority class of transfer. see JSONRPC2DataStreamMultiplexerPriority.go
+	Priority JSONRPC2DataStreamMultiplexerPriority
+
+	// bytes per second, 0 - no limit. applied by sender to slices of this
+	// transfer and announced to receiver, so it paces it's slice requests.
+	// see JSONRPC2DataStreamMultiplexerTokenBucket.go
+	RateLimit int64
+	// 0 - one second worth of data
+	RateLimitBurst int64
+
+	// how long buffer may stay not accessed by peer before it's expired.
+	// 0 - JSONRPC2DataStreamMultiplexer.BufferIdleExpiry.
+	// see JSONRPC2DataStreamMultiplexerBufferExpiry.go
+	IdleExpiry time.Duration
+
+	// ChannelDataReaderWithReply(): how long to wait for peer to start
+	// channelling reply, after it received the buffer.
+	// 0 - JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT.
+	// see JSONRPC2DataStreamMultiplexerReply.go
+	ReplyTimeout time.Duration
+
+	// parent span for transfer's span. nil - no parent.
+	// see JSONRPC2DataStreamMultiplexerTracing.go
+	Context context.Context
+
+	// set by ChannelDataReaderWithReply() and for replies
+	wants_reply bool
+	reply_to    string
+}
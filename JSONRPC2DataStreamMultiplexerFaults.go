@@ -0,0 +1,443 @@
+package gojsonrpc2datastreammultiplexer
+
+// fault injection for resilience testing.
+//
+// JSONRPC2DataStreamMultiplexerFaultInjector sits between multiplexer and
+// transport and can drop, duplicate, delay, truncate or corrupt protocol
+// messages, chosen by rules:
+//
+//	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+//	// drop 3rd gbs response for buffer X
+//	gbs_drop := faults.AddRule(
+//		JSONRPC2DataStreamMultiplexerFaultRule{
+//			Direction: JSONRPC2_MULTIPLEXER_RECORD_IN,
+//			Method:    JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE,
+//			Response:  true,
+//			BufferId:  X,
+//			Nth:       3,
+//			Action:    JSONRPC2_MULTIPLEXER_FAULT_DROP,
+//		},
+//	)
+//	...
+//	if gbs_drop.Fired() != 1 { ... }
+//
+// directions are of the side, injector is attached to: "out" - messages
+// sent by it, "in" - received by it. for JSONRPC2DataStreamMultiplexerPipePair
+// (options.Faults) that side is A.
+//
+// responses carry only id of request, so injector remembers requests
+// passed through it, to know method and buffer of responses. requests, which
+// are dropped or stay unanswered for JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT,
+// are forgotten.
+//
+// Close() stops delayed messages, which aren't delivered yet.
+// JSONRPC2DataStreamMultiplexerPipePair closes it's options.Faults on Close().
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type JSONRPC2DataStreamMultiplexerFaultAction int
+
+const (
+	JSONRPC2_MULTIPLEXER_FAULT_DROP JSONRPC2DataStreamMultiplexerFaultAction = iota
+	JSONRPC2_MULTIPLEXER_FAULT_DUPLICATE
+	// message is delivered after Delay, other messages aren't held
+	JSONRPC2_MULTIPLEXER_FAULT_DELAY
+	// only first TruncateTo bytes are delivered
+	JSONRPC2_MULTIPLEXER_FAULT_TRUNCATE
+	// CorruptBytes random bytes are changed
+	JSONRPC2_MULTIPLEXER_FAULT_CORRUPT
+)
+
+func (self JSONRPC2DataStreamMultiplexerFaultAction) String() string {
+	switch self {
+	case JSONRPC2_MULTIPLEXER_FAULT_DROP:
+		return "drop"
+	case JSONRPC2_MULTIPLEXER_FAULT_DUPLICATE:
+		return "duplicate"
+	case JSONRPC2_MULTIPLEXER_FAULT_DELAY:
+		return "delay"
+	case JSONRPC2_MULTIPLEXER_FAULT_TRUNCATE:
+		return "truncate"
+	case JSONRPC2_MULTIPLEXER_FAULT_CORRUPT:
+		return "corrupt"
+	}
+	return "unknown"
+}
+
+// empty fields (except Response) match anything. rule must not be changed after AddRule()
+type JSONRPC2DataStreamMultiplexerFaultRule struct {
+	// JSONRPC2_MULTIPLEXER_RECORD_IN or JSONRPC2_MULTIPLEXER_RECORD_OUT
+	Direction string
+
+	// false - rule matches requests, true - responses
+	Response bool
+	// method of request or, for responses, method of request,
+	// response is for
+	Method string
+
+	BufferId string
+
+	// rule fires on Nth (1-based) matching message only. 0 - on every one
+	Nth int
+
+	Action JSONRPC2DataStreamMultiplexerFaultAction
+
+	Delay time.Duration
+	// negative - number of bytes to cut from end
+	TruncateTo int
+	// 0 - 1
+	CorruptBytes int
+
+	injector *JSONRPC2DataStreamMultiplexerFaultInjector
+	matched  int
+	fired    int
+}
+
+// how many messages rule matched, including ones it didn't fire on
+func (self *JSONRPC2DataStreamMultiplexerFaultRule) Matched() int {
+	self.injector.mutex.Lock()
+	defer self.injector.mutex.Unlock()
+
+	return self.matched
+}
+
+func (self *JSONRPC2DataStreamMultiplexerFaultRule) Fired() int {
+	self.injector.mutex.Lock()
+	defer self.injector.mutex.Unlock()
+
+	return self.fired
+}
+
+// how often requests map is checked for unanswered requests
+const faultRequestsPruneInterval = 10 * time.Second
+
+// what injector knows about message
+type faultMessageInfo struct {
+	method   string
+	response bool
+	buffid   string
+
+	// for requests: key in requests map and time of passing injector
+	key  string
+	seen time.Time
+}
+
+type JSONRPC2DataStreamMultiplexerFaultInjector struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+	rules []*JSONRPC2DataStreamMultiplexerFaultRule
+
+	// direction of request + "/" + id -> request
+	requests map[string]faultMessageInfo
+	pruned   time.Time
+
+	// delayed messages
+	closed  bool
+	stop    chan struct{}
+	delayed sync.WaitGroup
+
+	logger *slog.Logger
+}
+
+// seed is for choosing bytes to corrupt
+func NewJSONRPC2DataStreamMultiplexerFaultInjector(
+	seed int64,
+) *JSONRPC2DataStreamMultiplexerFaultInjector {
+	self := new(JSONRPC2DataStreamMultiplexerFaultInjector)
+	self.rand = rand.New(rand.NewSource(seed))
+	self.requests = make(map[string]faultMessageInfo)
+	self.pruned = time.Now()
+	self.stop = make(chan struct{})
+	self.logger = NewJSONRPC2DataStreamMultiplexerNopLogger()
+	return self
+}
+
+// failures to deliver delayed messages are logged. nil - disable logging
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = NewJSONRPC2DataStreamMultiplexerNopLogger()
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.logger = logger
+}
+
+// delayed messages, which aren't delivered yet, are dropped. waits for
+// deliveries in progress. messages delayed after Close() are dropped too
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) Close() {
+	self.mutex.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.stop)
+	}
+	self.mutex.Unlock()
+
+	self.delayed.Wait()
+}
+
+// if several rules match message, first one, which fires, is applied
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) AddRule(
+	rule JSONRPC2DataStreamMultiplexerFaultRule,
+) *JSONRPC2DataStreamMultiplexerFaultRule {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ret := new(JSONRPC2DataStreamMultiplexerFaultRule)
+	*ret = rule
+	ret.injector = self
+	ret.matched = 0
+	ret.fired = 0
+
+	self.rules = append(self.rules, ret)
+
+	return ret
+}
+
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) ClearRules() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.rules = nil
+}
+
+// for use as PushMessageToOutsideCB:
+//
+//	mux.PushMessageToOutsideCB = faults.WrapPushMessageToOutsideCB(send)
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) WrapPushMessageToOutsideCB(
+	cb func(data []byte) error,
+) func(data []byte) error {
+	return func(data []byte) error {
+		return self.Apply(JSONRPC2_MULTIPLEXER_RECORD_OUT, data, cb)
+	}
+}
+
+// use instead of mux.PushMessageFromOutside(data). dropped and delayed
+// messages result in nil errors
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) PushMessageFromOutside(
+	mux *JSONRPC2DataStreamMultiplexer,
+	data []byte,
+) (error, error) {
+	var (
+		// delayed message is delivered after return
+		mutex     sync.Mutex
+		returned  bool
+		proto_err error
+	)
+
+	err := self.Apply(
+		JSONRPC2_MULTIPLEXER_RECORD_IN,
+		data,
+		func(data []byte) error {
+			p_err, err := mux.PushMessageFromOutside(data)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if !returned && p_err != nil {
+				proto_err = p_err
+			}
+			return err
+		},
+	)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	returned = true
+	return proto_err, err
+}
+
+// passes data to deliver, applying rules. direction is
+// JSONRPC2_MULTIPLEXER_RECORD_IN or JSONRPC2_MULTIPLEXER_RECORD_OUT.
+// deliver may be called more than once (duplicate) or later, from other
+// goroutine (delay)
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) Apply(
+	direction string,
+	data []byte,
+	deliver func(data []byte) error,
+) error {
+	info := self.inspect(direction, data)
+
+	self.mutex.Lock()
+
+	var rule *JSONRPC2DataStreamMultiplexerFaultRule
+	for _, r := range self.rules {
+		if !r.matches(direction, info) {
+			continue
+		}
+		r.matched++
+		if rule == nil && (r.Nth == 0 || r.Nth == r.matched) {
+			r.fired++
+			rule = r
+		}
+	}
+
+	if rule == nil {
+		self.mutex.Unlock()
+		return deliver(data)
+	}
+
+	// dropped request will never be answered
+	if rule.Action == JSONRPC2_MULTIPLEXER_FAULT_DROP && info.key != "" {
+		delete(self.requests, info.key)
+	}
+
+	// delayed message is counted under mutex, so Close() waits for it
+	delay_ok := false
+	if rule.Action == JSONRPC2_MULTIPLEXER_FAULT_DELAY && !self.closed {
+		self.delayed.Add(1)
+		delay_ok = true
+	}
+	logger := self.logger
+
+	// changed copy is made under mutex: rand isn't goroutine safe
+	var changed []byte
+	switch rule.Action {
+	case JSONRPC2_MULTIPLEXER_FAULT_TRUNCATE:
+		n := rule.TruncateTo
+		if n < 0 {
+			n = len(data) + n
+		}
+		n = max(0, min(n, len(data)))
+		changed = append([]byte(nil), data[:n]...)
+
+	case JSONRPC2_MULTIPLEXER_FAULT_CORRUPT:
+		changed = append([]byte(nil), data...)
+		if len(changed) != 0 {
+			for i := max(1, rule.CorruptBytes); i != 0; i-- {
+				changed[self.rand.Intn(len(changed))] ^= byte(1 + self.rand.Intn(255))
+			}
+		}
+	}
+
+	self.mutex.Unlock()
+
+	switch rule.Action {
+	case JSONRPC2_MULTIPLEXER_FAULT_DROP:
+		return nil
+
+	case JSONRPC2_MULTIPLEXER_FAULT_DUPLICATE:
+		err := deliver(data)
+		if err != nil {
+			return err
+		}
+		return deliver(append([]byte(nil), data...))
+
+	case JSONRPC2_MULTIPLEXER_FAULT_DELAY:
+		if !delay_ok {
+			return nil
+		}
+		data = append([]byte(nil), data...)
+		go func() {
+			defer self.delayed.Done()
+
+			t := time.NewTimer(rule.Delay)
+			defer t.Stop()
+
+			select {
+			case <-t.C:
+			case <-self.stop:
+				return
+			}
+
+			err := deliver(data)
+			if err != nil {
+				logger.Warn(
+					"can't deliver delayed message",
+					"direction", direction,
+					"size", len(data),
+					"err", err,
+				)
+			}
+		}()
+		return nil
+
+	case JSONRPC2_MULTIPLEXER_FAULT_TRUNCATE, JSONRPC2_MULTIPLEXER_FAULT_CORRUPT:
+		return deliver(changed)
+	}
+
+	return deliver(data)
+}
+
+// remembers requests and finds requests of responses
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) inspect(
+	direction string,
+	data []byte,
+) faultMessageInfo {
+	var msg struct {
+		Id     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params struct {
+			BufferId string `json:"id"`
+		} `json:"params"`
+	}
+
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return faultMessageInfo{}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if msg.Method != "" {
+		info := faultMessageInfo{method: msg.Method, buffid: msg.Params.BufferId}
+		if len(msg.Id) != 0 && string(msg.Id) != "null" {
+			self.pruneRequests()
+			info.key = direction + "/" + string(msg.Id)
+			info.seen = time.Now()
+			self.requests[info.key] = info
+		}
+		return info
+	}
+
+	request_direction := JSONRPC2_MULTIPLEXER_RECORD_OUT
+	if direction == JSONRPC2_MULTIPLEXER_RECORD_OUT {
+		request_direction = JSONRPC2_MULTIPLEXER_RECORD_IN
+	}
+
+	key := request_direction + "/" + string(msg.Id)
+	info, ok := self.requests[key]
+	if !ok {
+		// response to unknown (or already answered) request
+		return faultMessageInfo{response: true}
+	}
+	delete(self.requests, key)
+
+	info.response = true
+	info.key = ""
+	return info
+}
+
+// forgets requests, which are left unanswered. self.mutex must be locked
+func (self *JSONRPC2DataStreamMultiplexerFaultInjector) pruneRequests() {
+	now := time.Now()
+	if now.Sub(self.pruned) < faultRequestsPruneInterval {
+		return
+	}
+	self.pruned = now
+
+	for k, v := range self.requests {
+		if now.Sub(v.seen) > JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT {
+			delete(self.requests, k)
+		}
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerFaultRule) matches(
+	direction string,
+	info faultMessageInfo,
+) bool {
+	return (self.Direction == "" || self.Direction == direction) &&
+		(self.Method == "" || self.Method == info.method) &&
+		self.Response == info.response &&
+		(self.BufferId == "" || self.BufferId == info.buffid)
+}
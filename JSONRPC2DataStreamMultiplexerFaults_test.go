@@ -0,0 +1,223 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// channels data from A to B through faults. fails test, if transfer doesn't
+// succeed or data is damaged
+func testTransferWithFaults(t *testing.T, faults *JSONRPC2DataStreamMultiplexerFaultInjector) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{
+			Latency: time.Millisecond,
+			Faults:  faults,
+		},
+	)
+	defer p.Close()
+
+	// lost slices are requested again quickly
+	policy := DefaultJSONRPC2DataStreamMultiplexerRetryPolicy()
+	policy.MinTimeout = 100 * time.Millisecond
+	p.B.RetryPolicy = policy
+
+	data := testData(16*JSONRPC2_MULTIPLEXER_SLICE_SIZE, 1)
+
+	var (
+		received_mutex sync.Mutex
+		received       [][]byte
+		received_wg    sync.WaitGroup
+	)
+	received_wg.Add(1)
+
+	p.B.OnIncommingDataTransferComplete = func(ws io.WriteSeeker) {
+		received_mutex.Lock()
+		defer received_mutex.Unlock()
+
+		received = append(received, readAllWriteSeeker(t, ws))
+		if len(received) == 1 {
+			received_wg.Done()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		timedout, closed, _, proto_err, err := p.A.ChannelData(data)
+		if timedout || closed || proto_err != nil || err != nil {
+			t.Error("transfer failed:", timedout, closed, proto_err, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer didn't recover")
+	}
+
+	if !waitGroupTimeout(t, &received_wg, 5*time.Second) {
+		t.FailNow()
+	}
+
+	received_mutex.Lock()
+	defer received_mutex.Unlock()
+
+	if len(received) != 1 {
+		t.Fatal("data received", len(received), "times")
+	}
+	if !bytes.Equal(received[0], data) {
+		t.Fatal("received data differs from sent")
+	}
+}
+
+func TestFaultDropNthSliceResponse(t *testing.T) {
+	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+	rule := faults.AddRule(
+		JSONRPC2DataStreamMultiplexerFaultRule{
+			Direction: JSONRPC2_MULTIPLEXER_RECORD_OUT,
+			Method:    JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE,
+			Response:  true,
+			Nth:       3,
+			Action:    JSONRPC2_MULTIPLEXER_FAULT_DROP,
+		},
+	)
+
+	testTransferWithFaults(t, faults)
+
+	if rule.Fired() != 1 {
+		t.Fatal("rule fired", rule.Fired(), "times")
+	}
+}
+
+func TestFaultDuplicateNthSliceResponse(t *testing.T) {
+	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+	rule := faults.AddRule(
+		JSONRPC2DataStreamMultiplexerFaultRule{
+			Direction: JSONRPC2_MULTIPLEXER_RECORD_OUT,
+			Method:    JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE,
+			Response:  true,
+			Nth:       3,
+			Action:    JSONRPC2_MULTIPLEXER_FAULT_DUPLICATE,
+		},
+	)
+
+	testTransferWithFaults(t, faults)
+
+	if rule.Fired() != 1 {
+		t.Fatal("rule fired", rule.Fired(), "times")
+	}
+}
+
+func TestFaultDropAnnouncementResponse(t *testing.T) {
+	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+	rule := faults.AddRule(
+		JSONRPC2DataStreamMultiplexerFaultRule{
+			Direction: JSONRPC2_MULTIPLEXER_RECORD_IN,
+			Method:    JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE,
+			Response:  true,
+			Action:    JSONRPC2_MULTIPLEXER_FAULT_DROP,
+		},
+	)
+
+	testTransferWithFaults(t, faults)
+
+	if rule.Fired() != 1 {
+		t.Fatal("rule fired", rule.Fired(), "times")
+	}
+}
+
+func TestFaultDelayAnnouncementResponse(t *testing.T) {
+	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+	rule := faults.AddRule(
+		JSONRPC2DataStreamMultiplexerFaultRule{
+			Direction: JSONRPC2_MULTIPLEXER_RECORD_IN,
+			Method:    JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE,
+			Response:  true,
+			Action:    JSONRPC2_MULTIPLEXER_FAULT_DELAY,
+			Delay:     300 * time.Millisecond,
+		},
+	)
+
+	testTransferWithFaults(t, faults)
+
+	if rule.Fired() != 1 {
+		t.Fatal("rule fired", rule.Fired(), "times")
+	}
+}
+
+func TestFaultInjectorForgetsDroppedRequests(t *testing.T) {
+	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+	faults.AddRule(
+		JSONRPC2DataStreamMultiplexerFaultRule{
+			Direction: JSONRPC2_MULTIPLEXER_RECORD_OUT,
+			Method:    JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO,
+			Action:    JSONRPC2_MULTIPLEXER_FAULT_DROP,
+		},
+	)
+
+	deliver := func([]byte) error { return nil }
+	for i := 0; i != 100; i++ {
+		faults.Apply(
+			JSONRPC2_MULTIPLEXER_RECORD_OUT,
+			[]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"gbi","params":{"id":"x"}}`, i)),
+			deliver,
+		)
+	}
+
+	faults.mutex.Lock()
+	defer faults.mutex.Unlock()
+
+	if len(faults.requests) != 0 {
+		t.Fatal("dropped requests are remembered:", len(faults.requests))
+	}
+}
+
+func TestFaultInjectorCloseStopsDelayed(t *testing.T) {
+	faults := NewJSONRPC2DataStreamMultiplexerFaultInjector(1)
+	faults.AddRule(
+		JSONRPC2DataStreamMultiplexerFaultRule{
+			Action: JSONRPC2_MULTIPLEXER_FAULT_DELAY,
+			Delay:  time.Hour,
+		},
+	)
+
+	var (
+		mutex     sync.Mutex
+		delivered int
+	)
+	deliver := func([]byte) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		delivered++
+		return nil
+	}
+
+	faults.Apply(JSONRPC2_MULTIPLEXER_RECORD_OUT, []byte(`{"jsonrpc":"2.0","method":"pi"}`), deliver)
+
+	closed := make(chan struct{})
+	go func() {
+		faults.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() waits for delayed message")
+	}
+
+	// delayed after Close() - dropped
+	faults.Apply(JSONRPC2_MULTIPLEXER_RECORD_OUT, []byte(`{"jsonrpc":"2.0","method":"pi"}`), deliver)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if delivered != 0 {
+		t.Fatal("delayed messages delivered after Close():", delivered)
+	}
+}
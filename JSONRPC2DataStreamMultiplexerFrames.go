@@ -0,0 +1,60 @@
+package gojsonrpc2datastreammultiplexer
+
+// length-prefixed framing of messages, for stream transports (pipes,
+// sockets, files).
+//
+// each frame is 4 byte big-endian length followed by message itself.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frames, longer than this, are rejected by ReadJSONRPC2DataStreamMultiplexerFrame
+const JSONRPC2_MULTIPLEXER_MAX_FRAME_SIZE = 16 * 1024 * 1024
+
+var ErrFrameTooLarge = errors.New("frame is too large")
+
+func WriteJSONRPC2DataStreamMultiplexerFrame(w io.Writer, data []byte) error {
+	if len(data) > JSONRPC2_MULTIPLEXER_MAX_FRAME_SIZE {
+		return ErrFrameTooLarge
+	}
+
+	// one Write() call, so concurrent writers to unbuffered w (with own
+	// locking) don't interleave header and body
+	b := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], data)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// returns io.EOF if stream ended on frame boundary and
+// io.ErrUnexpectedEOF if it ended inside of frame
+func ReadJSONRPC2DataStreamMultiplexerFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > JSONRPC2_MULTIPLEXER_MAX_FRAME_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	ret := make([]byte, size)
+	_, err = io.ReadFull(r, ret)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,74 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFramesRoundTrip(t *testing.T) {
+	messages := [][]byte{
+		[]byte(`{"jsonrpc":"2.0","method":"n","params":{"id":"abc"},"id":1}`),
+		{},
+		testData(3*JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE, 1),
+	}
+
+	b := new(bytes.Buffer)
+	for _, m := range messages {
+		err := WriteJSONRPC2DataStreamMultiplexerFrame(b, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, m := range messages {
+		got, err := ReadJSONRPC2DataStreamMultiplexerFrame(b)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(got, m) {
+			t.Fatalf("#%d: frame damaged", i)
+		}
+	}
+
+	_, err := ReadJSONRPC2DataStreamMultiplexerFrame(b)
+	if err != io.EOF {
+		t.Fatal("expected io.EOF on frame boundary, got", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	err := WriteJSONRPC2DataStreamMultiplexerFrame(
+		io.Discard,
+		make([]byte, JSONRPC2_MULTIPLEXER_MAX_FRAME_SIZE+1),
+	)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatal("write: expected ErrFrameTooLarge, got", err)
+	}
+
+	// reader must refuse before allocating frame
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], JSONRPC2_MULTIPLEXER_MAX_FRAME_SIZE+1)
+	_, err = ReadJSONRPC2DataStreamMultiplexerFrame(bytes.NewReader(header[:]))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatal("read: expected ErrFrameTooLarge, got", err)
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	b := new(bytes.Buffer)
+	err := WriteJSONRPC2DataStreamMultiplexerFrame(b, []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := b.Bytes()
+
+	for _, cut := range []int{1, 3, 4, len(frame) - 1} {
+		_, err := ReadJSONRPC2DataStreamMultiplexerFrame(bytes.NewReader(frame[:cut]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut at %d: expected io.ErrUnexpectedEOF, got %v", cut, err)
+		}
+	}
+}
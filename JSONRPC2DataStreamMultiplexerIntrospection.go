@@ -0,0 +1,224 @@
+package gojsonrpc2datastreammultiplexer
+
+// introspection of transfers in progress.
+//
+// ListTransfers() returns outgoing buffers (announced by this side and not
+// yet unregistered) and incomming pulls (buffers announced by peer, which
+// are being received). Stats() returns summary of multiplexer state.
+// both are meant for debug pages and are safe to call at any time.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type JSONRPC2DataStreamMultiplexerIncommingTransferSnapshot struct {
+	BufferId string
+	Priority JSONRPC2DataStreamMultiplexerPriority
+	// -1 - size isn't known yet (gbi not answered)
+	Size          int64
+	BytesReceived int64
+	// retries of gbi and gbs requests made for this buffer
+	Retries int64
+	// slice being requested now. both are 0, if no slice was requested yet
+	SliceStart int64
+	SliceEnd   int64
+	Started    time.Time
+	// time since Started, at the moment of snapshot
+	Age time.Duration
+}
+
+type JSONRPC2DataStreamMultiplexerTransfers struct {
+	// sorted by creation time
+	Outgoing []JSONRPC2DataStreamMultiplexerBufferSnapshot
+	// sorted by start time
+	Incomming []JSONRPC2DataStreamMultiplexerIncommingTransferSnapshot
+}
+
+type JSONRPC2DataStreamMultiplexerStats struct {
+	Name string
+
+	PeerIdentity      string
+	PeerAuthenticated bool
+	PeerGoingAway     bool
+
+	Closed       bool
+	ShuttingDown bool
+
+	// false - no response was measured yet
+	RTTKnown bool
+	RTT      time.Duration
+
+	OutgoingTransfers int
+	// sum of BytesServed of outgoing transfers
+	OutgoingBytesServed int64
+
+	IncommingTransfers int
+	// sum of BytesReceived of incomming transfers
+	IncommingBytesReceived int64
+	// sum of Retries of incomming transfers
+	IncommingRetries int64
+
+	// see JSONRPC2DataStreamMultiplexerReceiveScheduler.go
+	QueuedPulls    int
+	SlicesInFlight int
+}
+
+type incommingTransfer struct {
+	mutex sync.Mutex
+
+	buffid         string
+	priority       JSONRPC2DataStreamMultiplexerPriority
+	size           int64
+	bytes_received int64
+	retries        int64
+	slice_start    int64
+	slice_end      int64
+	started        time.Time
+}
+
+func (self *incommingTransfer) setSize(size int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.size = size
+}
+
+func (self *incommingTransfer) setSlice(start int64, end int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.slice_start = start
+	self.slice_end = end
+}
+
+func (self *incommingTransfer) received(size int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.bytes_received += size
+}
+
+// passed as 'on_retry' to requestSendingRespWaitingRoutine()
+func (self *incommingTransfer) retried() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.retries++
+}
+
+func (self *incommingTransfer) snapshot() JSONRPC2DataStreamMultiplexerIncommingTransferSnapshot {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return JSONRPC2DataStreamMultiplexerIncommingTransferSnapshot{
+		BufferId:      self.buffid,
+		Priority:      self.priority,
+		Size:          self.size,
+		BytesReceived: self.bytes_received,
+		Retries:       self.retries,
+		SliceStart:    self.slice_start,
+		SliceEnd:      self.slice_end,
+		Started:       self.started,
+		Age:           time.Since(self.started),
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) registerIncommingTransfer(
+	buffid string,
+	priority JSONRPC2DataStreamMultiplexerPriority,
+) *incommingTransfer {
+	ret := &incommingTransfer{
+		buffid:   buffid,
+		priority: priority,
+		size:     -1,
+		started:  time.Now(),
+	}
+
+	self.incomming_transfers_mutex.Lock()
+	defer self.incomming_transfers_mutex.Unlock()
+
+	self.incomming_transfers[buffid] = ret
+
+	return ret
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) unregisterIncommingTransfer(buffid string) {
+	self.incomming_transfers_mutex.Lock()
+	defer self.incomming_transfers_mutex.Unlock()
+
+	delete(self.incomming_transfers, buffid)
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) ListTransfers() *JSONRPC2DataStreamMultiplexerTransfers {
+	ret := new(JSONRPC2DataStreamMultiplexerTransfers)
+
+	ret.Outgoing = self.BufferRegistrySnapshot()
+	sort.Slice(
+		ret.Outgoing,
+		func(i, j int) bool {
+			return ret.Outgoing[i].Created.Before(ret.Outgoing[j].Created)
+		},
+	)
+
+	self.incomming_transfers_mutex.Lock()
+	transfers := make([]*incommingTransfer, 0, len(self.incomming_transfers))
+	for _, t := range self.incomming_transfers {
+		transfers = append(transfers, t)
+	}
+	self.incomming_transfers_mutex.Unlock()
+
+	ret.Incomming = make(
+		[]JSONRPC2DataStreamMultiplexerIncommingTransferSnapshot,
+		0,
+		len(transfers),
+	)
+	for _, t := range transfers {
+		ret.Incomming = append(ret.Incomming, t.snapshot())
+	}
+	sort.Slice(
+		ret.Incomming,
+		func(i, j int) bool {
+			return ret.Incomming[i].Started.Before(ret.Incomming[j].Started)
+		},
+	)
+
+	return ret
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) Stats() *JSONRPC2DataStreamMultiplexerStats {
+	ret := new(JSONRPC2DataStreamMultiplexerStats)
+
+	ret.Name = self.GetDebugName()
+
+	ret.PeerIdentity = self.GetPeerIdentity()
+	ret.PeerAuthenticated = self.isPeerAuthenticated()
+	ret.PeerGoingAway = self.isPeerGoingAway()
+
+	self.state_mutex.Lock()
+	ret.Closed = self.closed
+	ret.ShuttingDown = self.shutting_down
+	self.state_mutex.Unlock()
+
+	ret.RTT, ret.RTTKnown = self.RTT()
+
+	transfers := self.ListTransfers()
+
+	ret.OutgoingTransfers = len(transfers.Outgoing)
+	for _, t := range transfers.Outgoing {
+		ret.OutgoingBytesServed += t.BytesServed
+	}
+
+	ret.IncommingTransfers = len(transfers.Incomming)
+	for _, t := range transfers.Incomming {
+		ret.IncommingBytesReceived += t.BytesReceived
+		ret.IncommingRetries += t.Retries
+	}
+
+	queue := self.receive_scheduler.QueueState()
+	ret.QueuedPulls = len(queue.Queued)
+	ret.SlicesInFlight = queue.SlicesInFlight
+
+	return ret
+}
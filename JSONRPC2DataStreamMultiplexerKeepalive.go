@@ -0,0 +1,157 @@
+package gojsonrpc2datastreammultiplexer
+
+// keepalive / liveness detection for the peer link.
+//
+// after StartKeepalive(), JSONRPC2DataStreamMultiplexer pings peer ("pi" request)
+// every 'interval'. each answered ping is RTT sample (see RTT()). if
+// 'max_missed' pings in a row are not answered, peer is considered lost:
+// all requests waiting for peer's responses (and so all in-flight transfers on
+// both sides) fail with ErrPeerLost, and OnPeerLost callback is called.
+// pinging continues, so if peer returns, link can be used again.
+
+import (
+	"errors"
+	"time"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_METHOD_PING = "pi"
+)
+
+var ErrPeerLost = errors.New("peer lost")
+
+func (self *JSONRPC2DataStreamMultiplexer) StartKeepalive(
+	interval time.Duration,
+	max_missed int,
+) error {
+	if self.isClosed() {
+		return ErrClosed
+	}
+
+	if interval <= 0 {
+		return errors.New("invalid 'interval' value")
+	}
+
+	if max_missed < 1 {
+		max_missed = 1
+	}
+
+	self.keepalive_mutex.Lock()
+	defer self.keepalive_mutex.Unlock()
+
+	if self.keepalive_stop != nil {
+		return errors.New("keepalive already started")
+	}
+
+	stop := make(chan struct{})
+	self.keepalive_stop = stop
+
+	go self.keepaliveRoutine(interval, max_missed, stop)
+
+	return nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) StopKeepalive() {
+	self.keepalive_mutex.Lock()
+	defer self.keepalive_mutex.Unlock()
+
+	if self.keepalive_stop != nil {
+		close(self.keepalive_stop)
+		self.keepalive_stop = nil
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) keepaliveRoutine(
+	interval time.Duration,
+	max_missed int,
+	stop chan struct{},
+) {
+	missed := 0
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		timeout := self.requestTimeout(0, 0, 1)
+		if timeout > interval {
+			timeout = interval
+		}
+
+		m := new(gojsonrpc2.Message)
+		m.Method = JSONRPC2_MULTIPLEXER_METHOD_PING
+		m.Params = map[string]any{}
+
+		_, closed, _, proto_err, err :=
+			self.requestSendingRespWaitingRoutine(m, nil, timeout, 0, false, nil, nil)
+
+		if closed {
+			return
+		}
+
+		if proto_err == nil && err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+
+		if self.debug {
+			self.DebugPrintln("keepalive: ping failed", missed, "of", max_missed, ":", proto_err, err)
+		}
+
+		if missed == max_missed {
+			self.peerLost()
+		}
+	}
+}
+
+// returns channel, which is closed when peer is lost. channel is replaced
+// each time peer is lost, so it should be obtained before waiting
+func (self *JSONRPC2DataStreamMultiplexer) getPeerLostChan() <-chan struct{} {
+	self.keepalive_mutex.Lock()
+	defer self.keepalive_mutex.Unlock()
+
+	return self.peer_lost_chan
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) peerLost() {
+	if self.debug {
+		self.DebugPrintln("peer lost")
+	}
+	self.logger.Warn("peer lost", "peer", self.GetPeerIdentity())
+
+	func() {
+		self.keepalive_mutex.Lock()
+		defer self.keepalive_mutex.Unlock()
+
+		// wake everyone waiting for peer
+		close(self.peer_lost_chan)
+		self.peer_lost_chan = make(chan struct{})
+	}()
+
+	if self.OnPeerLost != nil {
+		go self.OnPeerLost()
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_PING(msg *gojsonrpc2.Message) (
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	err = self.sendResult(msg, map[string]any{})
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	return false, false, nil, nil
+}
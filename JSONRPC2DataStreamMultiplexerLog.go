@@ -0,0 +1,76 @@
+package gojsonrpc2datastreammultiplexer
+
+// logging.
+//
+// JSONRPC2DataStreamMultiplexer writes diagnostics to *slog.Logger set with
+// SetLogger(). by default nothing is logged.
+//
+// notable events (transfer outcomes, expiry, peer loss, authentication) are
+// logged with Info/Warn level and structured fields (buffer_id, request_id,
+// start/end offsets, peer). SetDebug(true) additionally enables verbose
+// DebugPrintln() tracing, which is logged with Debug level.
+//
+// every record has "name" field, set with SetDebugName().
+//
+// Warn+ records are also kept for RecentErrors().
+// see JSONRPC2DataStreamMultiplexerRecentErrors.go
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+type discardLogHandler struct{}
+
+func (discardLogHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardLogHandler) Handle(context.Context, slog.Record) error { return nil }
+func (self discardLogHandler) WithAttrs([]slog.Attr) slog.Handler   { return self }
+func (self discardLogHandler) WithGroup(string) slog.Handler        { return self }
+
+// logger, which discards everything
+func NewJSONRPC2DataStreamMultiplexerNopLogger() *slog.Logger {
+	return slog.New(discardLogHandler{})
+}
+
+// nil - disable logging. should be called before multiplexer is used
+func (self *JSONRPC2DataStreamMultiplexer) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = NewJSONRPC2DataStreamMultiplexerNopLogger()
+	}
+	self.base_logger = logger
+	self.logger = slog.New(
+		&recentErrorsLogHandler{
+			next: logger.Handler(),
+			ring: self.recent_errors,
+		},
+	).With("name", self.debugName)
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) GetLogger() *slog.Logger {
+	return self.logger
+}
+
+// formats DebugPrintln() arguments same way fmt.Println() does
+func debugSprintln(data ...any) string {
+	return strings.TrimSuffix(fmt.Sprintln(data...), "\n")
+}
+
+// message description for logs: without payload (which may be large)
+func msgSummary(m *gojsonrpc2.Message) string {
+	if m == nil {
+		return "<nil>"
+	}
+
+	ret := fmt.Sprintf("id=%v", m.Id)
+	if m.Method != "" {
+		ret += " method=" + m.Method
+	}
+	if m.Error != nil {
+		ret += fmt.Sprintf(" error=%d:%s", m.Error.Code, m.Error.Message)
+	}
+	return ret
+}
@@ -0,0 +1,354 @@
+package gojsonrpc2datastreammultiplexer
+
+// metrics.
+//
+// if JSONRPC2DataStreamMultiplexer.Metrics is set, multiplexer reports
+// protocol traffic and transfer events to it. methods are called from
+// different goroutines, so implementation must be thread-safe.
+//
+// JSONRPC2DataStreamMultiplexerCountingMetrics is ready to use implementation,
+// which can be exported with expvar (Publish()) or in Prometheus text
+// format (WritePrometheus()).
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JSONRPC2DataStreamMultiplexerMetrics interface {
+	// method arguments are known protocol methods or
+	// JSONRPC2_MULTIPLEXER_METRICS_METHOD_OTHER
+
+	// request received from peer
+	MessageIn(method string)
+	// request sent to peer (each attempt)
+	MessageOut(method string)
+
+	// bytes passed to PushMessageToOutsideCB
+	BytesSent(n int)
+	// bytes passed to PushMessageFromOutside()
+	BytesReceived(n int)
+
+	Retry(method string)
+	Timeout(method string)
+	// invalid requests from peer and invalid responses on own requests
+	ProtocolError(method string)
+
+	TransferStarted(outgoing bool)
+	TransferFinished(outgoing bool, ok bool)
+
+	// time between sending gbs request and getting response
+	SliceLatency(d time.Duration)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) MessageIn(string)            {}
+func (nopMetrics) MessageOut(string)           {}
+func (nopMetrics) BytesSent(int)               {}
+func (nopMetrics) BytesReceived(int)           {}
+func (nopMetrics) Retry(string)                {}
+func (nopMetrics) Timeout(string)              {}
+func (nopMetrics) ProtocolError(string)        {}
+func (nopMetrics) TransferStarted(bool)        {}
+func (nopMetrics) TransferFinished(bool, bool) {}
+func (nopMetrics) SliceLatency(time.Duration)  {}
+
+func (self *JSONRPC2DataStreamMultiplexer) getMetrics() JSONRPC2DataStreamMultiplexerMetrics {
+	if self.Metrics == nil {
+		return nopMetrics{}
+	}
+	return self.Metrics
+}
+
+// method label for metrics. methods of incomming requests are chosen by
+// peer (even not authenticated one), so unknown methods are counted
+// together: number of label values must stay bounded
+const JSONRPC2_MULTIPLEXER_METRICS_METHOD_OTHER = "other"
+
+func metricsMethod(method string) string {
+	switch method {
+	case JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE,
+		JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO,
+		JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE,
+		JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE,
+		JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE,
+		JSONRPC2_MULTIPLEXER_METHOD_PING,
+		JSONRPC2_MULTIPLEXER_METHOD_GOAWAY,
+		JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE,
+		JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED:
+		return method
+	}
+	return JSONRPC2_MULTIPLEXER_METRICS_METHOD_OTHER
+}
+
+// upper bounds of slice latency histogram buckets, in seconds
+var JSONRPC2_MULTIPLEXER_SLICE_LATENCY_BUCKETS = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type JSONRPC2DataStreamMultiplexerHistogram struct {
+	// upper bounds, ascending
+	Buckets []float64
+	// Counts[i] - observations <= Buckets[i] (not cumulative).
+	// last item - observations > all bounds
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+func newHistogram(buckets []float64) JSONRPC2DataStreamMultiplexerHistogram {
+	return JSONRPC2DataStreamMultiplexerHistogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerHistogram) observe(v float64) {
+	i := sort.SearchFloat64s(self.Buckets, v)
+	self.Counts[i]++
+	self.Sum += v
+	self.Count++
+}
+
+func (self JSONRPC2DataStreamMultiplexerHistogram) copy() JSONRPC2DataStreamMultiplexerHistogram {
+	ret := self
+	ret.Buckets = append([]float64(nil), self.Buckets...)
+	ret.Counts = append([]uint64(nil), self.Counts...)
+	return ret
+}
+
+type JSONRPC2DataStreamMultiplexerMetricsSnapshot struct {
+	MessagesIn     map[string]uint64
+	MessagesOut    map[string]uint64
+	Retries        map[string]uint64
+	Timeouts       map[string]uint64
+	ProtocolErrors map[string]uint64
+
+	BytesSent     uint64
+	BytesReceived uint64
+
+	ActiveOutgoingTransfers  int64
+	ActiveIncommingTransfers int64
+	OutgoingTransfersOk      uint64
+	OutgoingTransfersFailed  uint64
+	IncommingTransfersOk     uint64
+	IncommingTransfersFailed uint64
+
+	SliceLatency JSONRPC2DataStreamMultiplexerHistogram
+}
+
+type JSONRPC2DataStreamMultiplexerCountingMetrics struct {
+	mutex sync.Mutex
+	s     JSONRPC2DataStreamMultiplexerMetricsSnapshot
+}
+
+func NewJSONRPC2DataStreamMultiplexerCountingMetrics() *JSONRPC2DataStreamMultiplexerCountingMetrics {
+	self := new(JSONRPC2DataStreamMultiplexerCountingMetrics)
+	self.s.MessagesIn = make(map[string]uint64)
+	self.s.MessagesOut = make(map[string]uint64)
+	self.s.Retries = make(map[string]uint64)
+	self.s.Timeouts = make(map[string]uint64)
+	self.s.ProtocolErrors = make(map[string]uint64)
+	self.s.SliceLatency = newHistogram(JSONRPC2_MULTIPLEXER_SLICE_LATENCY_BUCKETS)
+	return self
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) MessageIn(method string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.MessagesIn[method]++
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) MessageOut(method string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.MessagesOut[method]++
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) BytesSent(n int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.BytesSent += uint64(n)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) BytesReceived(n int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.BytesReceived += uint64(n)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) Retry(method string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.Retries[method]++
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) Timeout(method string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.Timeouts[method]++
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) ProtocolError(method string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.ProtocolErrors[method]++
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) TransferStarted(outgoing bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if outgoing {
+		self.s.ActiveOutgoingTransfers++
+	} else {
+		self.s.ActiveIncommingTransfers++
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) TransferFinished(outgoing bool, ok bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	switch {
+	case outgoing && ok:
+		self.s.OutgoingTransfersOk++
+	case outgoing:
+		self.s.OutgoingTransfersFailed++
+	case ok:
+		self.s.IncommingTransfersOk++
+	default:
+		self.s.IncommingTransfersFailed++
+	}
+	if outgoing {
+		self.s.ActiveOutgoingTransfers--
+	} else {
+		self.s.ActiveIncommingTransfers--
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) SliceLatency(d time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.s.SliceLatency.observe(d.Seconds())
+}
+
+func copyCounterMap(m map[string]uint64) map[string]uint64 {
+	ret := make(map[string]uint64, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) Snapshot() *JSONRPC2DataStreamMultiplexerMetricsSnapshot {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ret := self.s
+	ret.MessagesIn = copyCounterMap(self.s.MessagesIn)
+	ret.MessagesOut = copyCounterMap(self.s.MessagesOut)
+	ret.Retries = copyCounterMap(self.s.Retries)
+	ret.Timeouts = copyCounterMap(self.s.Timeouts)
+	ret.ProtocolErrors = copyCounterMap(self.s.ProtocolErrors)
+	ret.SliceLatency = self.s.SliceLatency.copy()
+	return &ret
+}
+
+// publishes snapshot as expvar variable 'name' (shown by expvar's
+// /debug/vars handler). like expvar.Publish(), panics if name is already used
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return self.Snapshot() }))
+}
+
+// writes metrics in Prometheus text exposition format. each metric name
+// is prefixed with 'prefix' (e.g. "jrpcmux_")
+func (self *JSONRPC2DataStreamMultiplexerCountingMetrics) WritePrometheus(w io.Writer, prefix string) error {
+	s := self.Snapshot()
+
+	pw := &promWriter{w: w, prefix: prefix}
+
+	pw.counterVec("messages_in_total", "requests received from peer", "method", s.MessagesIn)
+	pw.counterVec("messages_out_total", "requests sent to peer", "method", s.MessagesOut)
+	pw.counterVec("retries_total", "retried requests", "method", s.Retries)
+	pw.counterVec("timeouts_total", "timed out requests", "method", s.Timeouts)
+	pw.counterVec("protocol_errors_total", "protocol errors", "method", s.ProtocolErrors)
+
+	pw.header("sent_bytes_total", "bytes passed to PushMessageToOutsideCB", "counter")
+	pw.line("sent_bytes_total", "", float64(s.BytesSent))
+	pw.header("received_bytes_total", "bytes passed to PushMessageFromOutside", "counter")
+	pw.line("received_bytes_total", "", float64(s.BytesReceived))
+
+	pw.header("active_transfers", "transfers in progress", "gauge")
+	pw.line("active_transfers", `direction="out"`, float64(s.ActiveOutgoingTransfers))
+	pw.line("active_transfers", `direction="in"`, float64(s.ActiveIncommingTransfers))
+
+	pw.header("transfers_total", "finished transfers", "counter")
+	pw.line("transfers_total", `direction="out",result="ok"`, float64(s.OutgoingTransfersOk))
+	pw.line("transfers_total", `direction="out",result="failed"`, float64(s.OutgoingTransfersFailed))
+	pw.line("transfers_total", `direction="in",result="ok"`, float64(s.IncommingTransfersOk))
+	pw.line("transfers_total", `direction="in",result="failed"`, float64(s.IncommingTransfersFailed))
+
+	pw.histogram("slice_latency_seconds", "gbs request round trip time", s.SliceLatency)
+
+	return pw.err
+}
+
+type promWriter struct {
+	w      io.Writer
+	prefix string
+	err    error
+}
+
+func (self *promWriter) printf(format string, args ...any) {
+	if self.err != nil {
+		return
+	}
+	_, self.err = fmt.Fprintf(self.w, format, args...)
+}
+
+func (self *promWriter) header(name string, help string, typ string) {
+	self.printf("# HELP %s%s %s\n", self.prefix, name, help)
+	self.printf("# TYPE %s%s %s\n", self.prefix, name, typ)
+}
+
+func (self *promWriter) line(name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	self.printf("%s%s%s %g\n", self.prefix, name, labels, value)
+}
+
+// text exposition format escapes only these in label values
+var promLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (self *promWriter) counterVec(name string, help string, label string, m map[string]uint64) {
+	self.header(name, help, "counter")
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		self.line(name, fmt.Sprintf(`%s="%s"`, label, promLabelValueEscaper.Replace(k)), float64(m[k]))
+	}
+}
+
+func (self *promWriter) histogram(name string, help string, h JSONRPC2DataStreamMultiplexerHistogram) {
+	self.header(name, help, "histogram")
+
+	var cumulative uint64
+	for i, b := range h.Buckets {
+		cumulative += h.Counts[i]
+		self.line(name+"_bucket", fmt.Sprintf(`le="%g"`, b), float64(cumulative))
+	}
+	self.line(name+"_bucket", `le="+Inf"`, float64(h.Count))
+	self.line(name+"_sum", "", h.Sum)
+	self.line(name+"_count", "", float64(h.Count))
+}
@@ -0,0 +1,43 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetricsUnknownMethodsCountedAsOther(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	metrics := NewJSONRPC2DataStreamMultiplexerCountingMetrics()
+	p.B.Metrics = metrics
+
+	for i := 0; i != 10; i++ {
+		p.B.PushMessageFromOutside(
+			[]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"junk%d","params":{}}`, i+1, i)),
+		)
+	}
+
+	s := metrics.Snapshot()
+	if len(s.MessagesIn) != 1 || s.MessagesIn[JSONRPC2_MULTIPLEXER_METRICS_METHOD_OTHER] != 10 {
+		t.Fatal("unexpected MessagesIn:", s.MessagesIn)
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	metrics := NewJSONRPC2DataStreamMultiplexerCountingMetrics()
+	metrics.MessageIn("a\"b\\c\nd\x01é")
+
+	b := new(bytes.Buffer)
+	err := metrics.WritePrometheus(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `messages_in_total{method="a\"b\\c\nd` + "\x01é" + `"} 1`
+	if !strings.Contains(b.String(), expected+"\n") {
+		t.Fatalf("%q not found in output:\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,200 @@
+package gojsonrpc2datastreammultiplexer
+
+// JSONRPC2DataStreamMultiplexerNode is gojsonrpc2.JSONRPC2Node for links with
+// small frame size limit.
+//
+// application uses it as usual JSONRPC2Node (OnRequestCB, SendRequest(), etc.)
+// and connects it to the link using PushMessageToOutsideCB and
+// PushMessageFromOutside(). each frame on the link starts with one byte:
+//   - 'a' - application JSON-RPC message, which fits into frame;
+//   - 'm' - JSONRPC2DataStreamMultiplexer protocol message.
+//
+// application messages, which don't fit into frame, are channelled using
+// JSONRPC2DataStreamMultiplexer and passed to peer's node, when transfer is
+// complete. such messages are channelled asynchronously, so they may overtake
+// or be overtaken by other messages.
+//
+// delivery of large messages isn't confirmed to the caller: JSONRPC2Node's
+// send functions return nil as soon as channelling is started. if it fails
+// later, failure is logged and passed to OnLargeMessageFailed.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_NODE_FRAME_APP         byte = 'a'
+	JSONRPC2_MULTIPLEXER_NODE_FRAME_MULTIPLEXER byte = 'm'
+)
+
+// not a fully drop-in replacement for gojsonrpc2.JSONRPC2Node:
+//   - send errors of large messages are not returned by SendRequest(),
+//     SendResponse() and SendMessage() - use OnLargeMessageFailed;
+//   - ordering between large and small messages is not preserved.
+type JSONRPC2DataStreamMultiplexerNode struct {
+	// application side. don't change it's PushMessageToOutsideCB
+	*gojsonrpc2.JSONRPC2Node
+
+	// link side: frames to be sent to peer's node
+	PushMessageToOutsideCB func(data []byte) error
+
+	// optional. called (in separate goroutine) if large message couldn't be
+	// channelled to peer. data is the lost application message
+	OnLargeMessageFailed func(data []byte, timedout bool, closed bool, proto_err error, err error)
+
+	multiplexer *JSONRPC2DataStreamMultiplexer
+
+	debugName string
+	debug     bool
+	logger    *slog.Logger
+}
+
+func NewJSONRPC2DataStreamMultiplexerNode() *JSONRPC2DataStreamMultiplexerNode {
+	self := new(JSONRPC2DataStreamMultiplexerNode)
+	self.debugName = "JSONRPC2DataStreamMultiplexerNode"
+	self.logger = NewJSONRPC2DataStreamMultiplexerNopLogger()
+
+	self.JSONRPC2Node = gojsonrpc2.NewJSONRPC2Node()
+	self.JSONRPC2Node.PushMessageToOutsideCB = self.nodePushMessageToOutsideCB
+
+	self.multiplexer = NewJSONRPC2DataStreamMultiplexer()
+	self.multiplexer.PushMessageToOutsideCB = func(data []byte) error {
+		return self.pushFrame(JSONRPC2_MULTIPLEXER_NODE_FRAME_MULTIPLEXER, data)
+	}
+	self.multiplexer.OnIncommingDataTransferComplete = self.onIncommingLargeMessage
+
+	return self
+}
+
+// multiplexer used for large messages. can be used for tuning
+// (authentication, rate limits, keepalive, etc.)
+func (self *JSONRPC2DataStreamMultiplexerNode) GetMultiplexer() *JSONRPC2DataStreamMultiplexer {
+	return self.multiplexer
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) SetDebug(val bool) {
+	self.debug = val
+	self.JSONRPC2Node.SetDebug(val)
+	self.multiplexer.SetDebug(val)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) SetDebugName(name string) {
+	self.debugName = fmt.Sprintf("[%s]", name)
+	self.JSONRPC2Node.SetDebugName(fmt.Sprintf("%s [JSONRPC2Node]", self.debugName))
+	self.multiplexer.SetDebugName(fmt.Sprintf("%s [Multiplexer]", self.debugName))
+}
+
+// also sets logger of multiplexer. nil - disable logging
+func (self *JSONRPC2DataStreamMultiplexerNode) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = NewJSONRPC2DataStreamMultiplexerNopLogger()
+	}
+	self.logger = logger
+	self.multiplexer.SetLogger(logger)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) DebugPrintln(data ...any) {
+	self.logger.Debug(debugSprintln(data...), "name", self.debugName)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) Close() {
+	self.multiplexer.Close()
+	self.JSONRPC2Node.Close()
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) pushFrame(kind byte, data []byte) error {
+	if self.PushMessageToOutsideCB == nil {
+		return errors.New("PushMessageToOutsideCB is not set")
+	}
+
+	frame := make([]byte, 0, len(data)+1)
+	frame = append(frame, kind)
+	frame = append(frame, data...)
+
+	return self.PushMessageToOutsideCB(frame)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) nodePushMessageToOutsideCB(data []byte) error {
+	if len(data)+1 < JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE {
+		return self.pushFrame(JSONRPC2_MULTIPLEXER_NODE_FRAME_APP, data)
+	}
+
+	if self.debug {
+		self.DebugPrintln("message is too big for frame, channelling it. size:", len(data))
+	}
+
+	// not waiting: transfer needs peer to read frames, and peer may be
+	// blocked in it's own PushMessageFromOutside() until this call returns
+	go func() {
+		timedout, closed, _, proto_err, err := self.multiplexer.ChannelData(data)
+		if !timedout && !closed && proto_err == nil && err == nil {
+			return
+		}
+
+		if self.debug {
+			self.DebugPrintln("couldn't channel message:", timedout, closed, proto_err, err)
+		}
+
+		self.logger.Warn(
+			"large message lost: can't channel it",
+			"size", len(data),
+			"timedout", timedout,
+			"closed", closed,
+			"proto_err", proto_err,
+			"err", err,
+		)
+
+		if self.OnLargeMessageFailed != nil {
+			self.OnLargeMessageFailed(data, timedout, closed, proto_err, err)
+		}
+	}()
+
+	return nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexerNode) onIncommingLargeMessage(data io.WriteSeeker) {
+	b, err := readWriteSeeker(data)
+	if err != nil {
+		if self.debug {
+			self.DebugPrintln("can't read channelled message:", err)
+		}
+		self.logger.Warn("can't read channelled message", "err", err)
+		return
+	}
+
+	proto_err, err := self.JSONRPC2Node.PushMessageFromOutside(b)
+	if proto_err != nil || err != nil {
+		if self.debug {
+			self.DebugPrintln("channelled message rejected by node:", proto_err, err)
+		}
+		self.logger.Warn(
+			"channelled message rejected by node",
+			"size", len(b),
+			"proto_err", proto_err,
+			"err", err,
+		)
+	}
+}
+
+// pass frames received from peer's node here
+// #0 - protocol error
+// #1 - all errors
+func (self *JSONRPC2DataStreamMultiplexerNode) PushMessageFromOutside(data []byte) (error, error) {
+	if len(data) == 0 {
+		return errors.New("empty frame"), errors.New("protocol error")
+	}
+
+	switch data[0] {
+	case JSONRPC2_MULTIPLEXER_NODE_FRAME_APP:
+		return self.JSONRPC2Node.PushMessageFromOutside(data[1:])
+	case JSONRPC2_MULTIPLEXER_NODE_FRAME_MULTIPLEXER:
+		return self.multiplexer.PushMessageFromOutside(data[1:])
+	default:
+		return fmt.Errorf("unknown frame type: %q", data[0]), errors.New("protocol error")
+	}
+}
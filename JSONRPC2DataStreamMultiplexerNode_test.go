@@ -0,0 +1,136 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+// connects PushMessageToOutsideCB of 'from' to 'to', delivering frames in
+// order from separate goroutine. returned func stops delivery
+func testNodeLink(from, to *JSONRPC2DataStreamMultiplexerNode) func() {
+	frames := make(chan []byte, 1024)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	from.PushMessageToOutsideCB = func(data []byte) error {
+		select {
+		case frames <- append([]byte(nil), data...):
+			return nil
+		case <-stop:
+			return ErrPipeClosed
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case f := <-frames:
+				to.PushMessageFromOutside(f)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestNodeLargeRequestAndResponse(t *testing.T) {
+	a := NewJSONRPC2DataStreamMultiplexerNode()
+	b := NewJSONRPC2DataStreamMultiplexerNode()
+	defer a.Close()
+	defer b.Close()
+
+	defer testNodeLink(a, b)()
+	defer testNodeLink(b, a)()
+
+	request_param := strings.Repeat("q", 3*JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE)
+	response_result := strings.Repeat("r", 5*JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE)
+
+	b.OnRequestCB = func(msg *gojsonrpc2.Message) (error, error) {
+		params, _ := msg.Params.(map[string]any)
+		if msg.Method != "echo" || params["p"] != request_param {
+			t.Error("large request damaged")
+		}
+
+		resp := new(gojsonrpc2.Message)
+		resp.Id = msg.Id
+		resp.Response.Result = map[string]any{"r": response_result}
+		return nil, b.SendResponse(resp)
+	}
+
+	responses := make(chan *gojsonrpc2.Message, 1)
+
+	req := new(gojsonrpc2.Message)
+	req.Method = "echo"
+	req.Params = map[string]any{"p": request_param}
+	_, err := a.SendRequest(
+		req,
+		true,
+		false,
+		&gojsonrpc2.JSONRPC2NodeRespHandler{
+			OnTimeout:  func() { t.Error("request timed out") },
+			OnClose:    func() {},
+			OnResponse: func(m *gojsonrpc2.Message) { responses <- m },
+		},
+		10*time.Second,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case resp := <-responses:
+		result, _ := resp.Result.(map[string]any)
+		if result["r"] != response_result {
+			t.Fatal("large response damaged")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no response")
+	}
+}
+
+func TestNodeLargeMessageFailed(t *testing.T) {
+	a := NewJSONRPC2DataStreamMultiplexerNode()
+	defer a.Close()
+
+	// link is down
+	a.PushMessageToOutsideCB = func(data []byte) error {
+		return errors.New("link is down")
+	}
+
+	failed := make(chan []byte, 1)
+	a.OnLargeMessageFailed = func(data []byte, timedout bool, closed bool, proto_err error, err error) {
+		failed <- data
+	}
+
+	msg := new(gojsonrpc2.Message)
+	msg.Method = "notify"
+	msg.Params = map[string]any{"p": strings.Repeat("x", 2*JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE)}
+
+	// large message is channelled asynchronously: failure is reported later
+	err := a.SendMessage(msg)
+	if err != nil {
+		t.Fatal("unexpected synchronous error:", err)
+	}
+
+	select {
+	case data := <-failed:
+		if !strings.Contains(string(data), `"notify"`) {
+			t.Fatal("OnLargeMessageFailed got wrong message")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnLargeMessageFailed not called")
+	}
+}
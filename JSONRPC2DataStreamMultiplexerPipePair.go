@@ -0,0 +1,326 @@
+package gojsonrpc2datastreammultiplexer
+
+// in-memory loopback pair of multiplexers, for tests.
+//
+// NewJSONRPC2DataStreamMultiplexerPipePair() returns two multiplexers (A and
+// B), connected with in-process transport. messages are delivered in order,
+// one by one, by goroutine of each direction. transport can add latency,
+// reorder, drop and limit size of messages. faults for specific messages can
+// be injected with options.Faults (see JSONRPC2DataStreamMultiplexerFaults.go).
+//
+// all random decisions are made with math/rand seeded with options.Seed, so
+// same sequence of messages in one direction gets same treatment on each run.
+//
+// (asked for as NewPipePair(); named after other constructors of package)
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrPipeMessageTooLarge = errors.New("message is too large for pipe")
+var ErrPipeClosed = errors.New("pipe is closed")
+
+type JSONRPC2DataStreamMultiplexerPipeOptions struct {
+	// delay of each message
+	Latency time.Duration
+	// random delay, added to Latency: [0, Jitter). doesn't reorder messages
+	Jitter time.Duration
+
+	// probability (0..1) of message being delayed additionally by
+	// ReorderDelay, so messages sent after it overtake it
+	ReorderRate float64
+	// 0 - 2*Latency + 1ms
+	ReorderDelay time.Duration
+
+	// probability (0..1) of message being silently dropped
+	DropRate float64
+
+	// 0 - no limit. sending larger message fails with ErrPipeMessageTooLarge
+	MaxMessageSize int
+
+	Seed int64
+
+	// applied to messages before other options. injector is attached to A:
+	// A->B messages are "out", B->A - "in"
+	Faults *JSONRPC2DataStreamMultiplexerFaultInjector
+}
+
+type JSONRPC2DataStreamMultiplexerPipeStats struct {
+	Sent      uint64
+	Delivered uint64
+	Dropped   uint64
+	Reordered uint64
+	// rejected by MaxMessageSize
+	TooLarge uint64
+}
+
+type JSONRPC2DataStreamMultiplexerPipePair struct {
+	A *JSONRPC2DataStreamMultiplexer
+	B *JSONRPC2DataStreamMultiplexer
+
+	a_to_b *pipeDirection
+	b_to_a *pipeDirection
+	faults *JSONRPC2DataStreamMultiplexerFaultInjector
+
+	close_once sync.Once
+}
+
+// options may be nil
+func NewJSONRPC2DataStreamMultiplexerPipePair(
+	options *JSONRPC2DataStreamMultiplexerPipeOptions,
+) *JSONRPC2DataStreamMultiplexerPipePair {
+	var o JSONRPC2DataStreamMultiplexerPipeOptions
+	if options != nil {
+		o = *options
+	}
+	if o.ReorderDelay == 0 {
+		o.ReorderDelay = 2*o.Latency + time.Millisecond
+	}
+
+	self := new(JSONRPC2DataStreamMultiplexerPipePair)
+	self.faults = o.Faults
+
+	self.A = NewJSONRPC2DataStreamMultiplexer()
+	self.A.SetDebugName("pipe A")
+
+	self.B = NewJSONRPC2DataStreamMultiplexer()
+	self.B.SetDebugName("pipe B")
+
+	self.a_to_b = newPipeDirection(self.B, JSONRPC2_MULTIPLEXER_RECORD_OUT, o, o.Seed)
+	self.b_to_a = newPipeDirection(self.A, JSONRPC2_MULTIPLEXER_RECORD_IN, o, o.Seed+1)
+
+	self.A.PushMessageToOutsideCB = self.a_to_b.send
+	self.B.PushMessageToOutsideCB = self.b_to_a.send
+
+	go self.a_to_b.run()
+	go self.b_to_a.run()
+
+	return self
+}
+
+func (self *JSONRPC2DataStreamMultiplexerPipePair) StatsAToB() JSONRPC2DataStreamMultiplexerPipeStats {
+	return self.a_to_b.getStats()
+}
+
+func (self *JSONRPC2DataStreamMultiplexerPipePair) StatsBToA() JSONRPC2DataStreamMultiplexerPipeStats {
+	return self.b_to_a.getStats()
+}
+
+// stops delivery and closes both multiplexers (and options.Faults).
+// messages in flight are lost
+func (self *JSONRPC2DataStreamMultiplexerPipePair) Close() {
+	self.close_once.Do(
+		func() {
+			if self.faults != nil {
+				self.faults.Close()
+			}
+			self.a_to_b.close()
+			self.b_to_a.close()
+			self.A.Close()
+			self.B.Close()
+		},
+	)
+}
+
+type pipeMessage struct {
+	data []byte
+	due  time.Time
+	seq  uint64
+}
+
+// ordered by due time, then by sending order
+type pipeQueue []*pipeMessage
+
+func (self pipeQueue) Len() int { return len(self) }
+func (self pipeQueue) Less(i, j int) bool {
+	if self[i].due.Equal(self[j].due) {
+		return self[i].seq < self[j].seq
+	}
+	return self[i].due.Before(self[j].due)
+}
+func (self pipeQueue) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self *pipeQueue) Push(x any)   { *self = append(*self, x.(*pipeMessage)) }
+func (self *pipeQueue) Pop() any {
+	old := *self
+	ret := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return ret
+}
+
+type pipeDirection struct {
+	target *JSONRPC2DataStreamMultiplexer
+	// for options.Faults
+	direction string
+	options   JSONRPC2DataStreamMultiplexerPipeOptions
+
+	mutex    sync.Mutex
+	rand     *rand.Rand
+	queue    pipeQueue
+	seq      uint64
+	last_due time.Time
+	stats    JSONRPC2DataStreamMultiplexerPipeStats
+	closed   bool
+
+	wake      chan struct{}
+	stop      chan struct{}
+	stop_once sync.Once
+	stopped   chan struct{}
+}
+
+func newPipeDirection(
+	target *JSONRPC2DataStreamMultiplexer,
+	direction string,
+	options JSONRPC2DataStreamMultiplexerPipeOptions,
+	seed int64,
+) *pipeDirection {
+	self := new(pipeDirection)
+	self.target = target
+	self.direction = direction
+	self.options = options
+	self.rand = rand.New(rand.NewSource(seed))
+	self.wake = make(chan struct{}, 1)
+	self.stop = make(chan struct{})
+	self.stopped = make(chan struct{})
+	return self
+}
+
+// PushMessageToOutsideCB of sending multiplexer
+func (self *pipeDirection) send(data []byte) error {
+	if self.options.Faults != nil {
+		return self.options.Faults.Apply(self.direction, data, self.enqueue)
+	}
+	return self.enqueue(data)
+}
+
+func (self *pipeDirection) enqueue(data []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return ErrPipeClosed
+	}
+
+	if self.options.MaxMessageSize > 0 && len(data) > self.options.MaxMessageSize {
+		self.stats.TooLarge++
+		return ErrPipeMessageTooLarge
+	}
+
+	self.stats.Sent++
+
+	// random values are always drawn in same order, so decisions
+	// for n-th message don't depend on options being zero
+	drop := self.rand.Float64()
+	reorder := self.rand.Float64()
+	jitter := self.rand.Int63()
+
+	if drop < self.options.DropRate {
+		self.stats.Dropped++
+		return nil
+	}
+
+	due := time.Now().Add(self.options.Latency)
+	if self.options.Jitter > 0 {
+		due = due.Add(time.Duration(jitter % int64(self.options.Jitter)))
+	}
+
+	if reorder < self.options.ReorderRate {
+		self.stats.Reordered++
+		due = due.Add(self.options.ReorderDelay)
+	} else {
+		// jitter doesn't reorder
+		if due.Before(self.last_due) {
+			due = self.last_due
+		}
+		self.last_due = due
+	}
+
+	self.seq++
+	heap.Push(
+		&self.queue,
+		&pipeMessage{
+			data: append([]byte(nil), data...),
+			due:  due,
+			seq:  self.seq,
+		},
+	)
+
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (self *pipeDirection) run() {
+	defer close(self.stopped)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		self.mutex.Lock()
+
+		var (
+			next *pipeMessage
+			wait time.Duration = -1
+		)
+		if len(self.queue) != 0 {
+			wait = time.Until(self.queue[0].due)
+			if wait <= 0 {
+				next = heap.Pop(&self.queue).(*pipeMessage)
+			}
+		}
+
+		self.mutex.Unlock()
+
+		if next != nil {
+			// errors are receiver's business: it logs them itself
+			self.target.PushMessageFromOutside(next.data)
+
+			self.mutex.Lock()
+			self.stats.Delivered++
+			self.mutex.Unlock()
+			continue
+		}
+
+		var timer_chan <-chan time.Time
+		if wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			timer_chan = timer.C
+		}
+
+		select {
+		case <-self.stop:
+			return
+		case <-self.wake:
+		case <-timer_chan:
+		}
+	}
+}
+
+func (self *pipeDirection) close() {
+	self.mutex.Lock()
+	self.closed = true
+	self.mutex.Unlock()
+
+	self.stop_once.Do(func() { close(self.stop) })
+	<-self.stopped
+}
+
+func (self *pipeDirection) getStats() JSONRPC2DataStreamMultiplexerPipeStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.stats
+}
@@ -0,0 +1,199 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPipePairRoundTrip(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{
+			Latency: time.Millisecond,
+			Jitter:  time.Millisecond,
+		},
+	)
+	defer p.Close()
+
+	for _, c := range []struct {
+		name     string
+		from, to *JSONRPC2DataStreamMultiplexer
+	}{
+		{"A->B", p.A, p.B},
+		{"B->A", p.B, p.A},
+	} {
+		data := testData(10*JSONRPC2_MULTIPLEXER_SLICE_SIZE+7, 3)
+
+		received := make(chan []byte, 1)
+		c.to.OnIncommingDataTransferComplete = func(ws io.WriteSeeker) {
+			received <- readAllWriteSeeker(t, ws)
+		}
+
+		timedout, closed, _, proto_err, err := c.from.ChannelData(data)
+		if timedout || closed || proto_err != nil || err != nil {
+			t.Fatal(c.name, "transfer failed:", timedout, closed, proto_err, err)
+		}
+
+		select {
+		case r := <-received:
+			if !bytes.Equal(r, data) {
+				t.Fatal(c.name, "received data differs from sent")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(c.name, "data not received")
+		}
+	}
+
+	if s := p.StatsAToB(); s.Sent == 0 || s.Dropped != 0 || s.Delivered != s.Sent {
+		t.Fatal("unexpected A->B stats:", s)
+	}
+}
+
+// what happened to each message, sent to direction (without delivering)
+func pipeDecisions(options JSONRPC2DataStreamMultiplexerPipeOptions, seed int64, count int) []string {
+	d := newPipeDirection(nil, JSONRPC2_MULTIPLEXER_RECORD_OUT, options, seed)
+
+	ret := make([]string, 0, count)
+	for i := 0; i != count; i++ {
+		before := d.getStats()
+		d.enqueue([]byte(fmt.Sprint(i)))
+		after := d.getStats()
+
+		switch {
+		case after.Dropped != before.Dropped:
+			ret = append(ret, "dropped")
+		case after.Reordered != before.Reordered:
+			ret = append(ret, "reordered")
+		default:
+			ret = append(ret, "delivered")
+		}
+	}
+	return ret
+}
+
+func TestPipeSeedDeterminism(t *testing.T) {
+	options := JSONRPC2DataStreamMultiplexerPipeOptions{
+		DropRate:     0.3,
+		ReorderRate:  0.3,
+		ReorderDelay: time.Millisecond,
+	}
+
+	a := pipeDecisions(options, 42, 200)
+	b := pipeDecisions(options, 42, 200)
+	c := pipeDecisions(options, 43, 200)
+
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Fatal("same seed gives different decisions")
+	}
+	if fmt.Sprint(a) == fmt.Sprint(c) {
+		t.Fatal("different seeds give same decisions")
+	}
+}
+
+func TestPipeMaxMessageSize(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{MaxMessageSize: 100},
+	)
+	defer p.Close()
+
+	err := p.A.PushMessageToOutsideCB(make([]byte, 101))
+	if !errors.Is(err, ErrPipeMessageTooLarge) {
+		t.Fatal("expected ErrPipeMessageTooLarge, got", err)
+	}
+
+	err = p.A.PushMessageToOutsideCB(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := p.StatsAToB()
+	if s.TooLarge != 1 || s.Sent != 1 {
+		t.Fatal("unexpected stats:", s)
+	}
+}
+
+func TestPipeDropRate(t *testing.T) {
+	const count = 1000
+
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{DropRate: 0.5, Seed: 1},
+	)
+	defer p.Close()
+
+	for i := 0; i != count; i++ {
+		err := p.A.PushMessageToOutsideCB([]byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := p.StatsAToB()
+	if s.Sent != count || s.Dropped < count*4/10 || s.Dropped > count*6/10 {
+		t.Fatal("unexpected stats:", s)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.StatsAToB().Delivered != count-s.Dropped {
+		if time.Now().After(deadline) {
+			t.Fatal("not all messages delivered:", p.StatsAToB())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// delivery order of messages, sent to direction
+func pipeDeliveryOrder(options JSONRPC2DataStreamMultiplexerPipeOptions, count int) []uint64 {
+	d := newPipeDirection(nil, JSONRPC2_MULTIPLEXER_RECORD_OUT, options, 1)
+	for i := 0; i != count; i++ {
+		d.enqueue([]byte("{}"))
+	}
+
+	ret := make([]uint64, 0, count)
+	for len(d.queue) != 0 {
+		ret = append(ret, heap.Pop(&d.queue).(*pipeMessage).seq)
+	}
+	return ret
+}
+
+func TestPipeReorder(t *testing.T) {
+	const count = 100
+
+	order := pipeDeliveryOrder(
+		JSONRPC2DataStreamMultiplexerPipeOptions{
+			Latency: time.Millisecond,
+			Jitter:  time.Millisecond,
+		},
+		count,
+	)
+	for i, seq := range order {
+		if seq != uint64(i+1) {
+			t.Fatal("messages reordered without ReorderRate:", order)
+		}
+	}
+
+	order = pipeDeliveryOrder(
+		JSONRPC2DataStreamMultiplexerPipeOptions{
+			Latency:      time.Millisecond,
+			ReorderRate:  0.3,
+			ReorderDelay: 10 * time.Millisecond,
+		},
+		count,
+	)
+	if len(order) != count {
+		t.Fatal("messages lost:", len(order))
+	}
+	reordered := false
+	for i, seq := range order {
+		if seq != uint64(i+1) {
+			reordered = true
+			break
+		}
+	}
+	if !reordered {
+		t.Fatal("messages not reordered with ReorderRate")
+	}
+}
@@ -0,0 +1,221 @@
+package gojsonrpc2datastreammultiplexer
+
+// priority classes for transfers.
+//
+// priority is set by sender using JSONRPC2DataStreamMultiplexerChannelDataOptions
+// and announced to receiver in "n" request. sender honours it when ordering
+// outgoing messages through PushMessageToOutsideCB, receiver - when scheduling
+// slice fetches.
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+type JSONRPC2DataStreamMultiplexerPriority int
+
+const (
+	JSONRPC2_MULTIPLEXER_PRIORITY_BULK   JSONRPC2DataStreamMultiplexerPriority = -1
+	JSONRPC2_MULTIPLEXER_PRIORITY_NORMAL JSONRPC2DataStreamMultiplexerPriority = 0
+	JSONRPC2_MULTIPLEXER_PRIORITY_HIGH   JSONRPC2DataStreamMultiplexerPriority = 1
+)
+
+// messages not related to any buffer (handshake, errors, etc.)
+// are small and urgent
+const JSONRPC2_MULTIPLEXER_PRIORITY_CONTROL = JSONRPC2_MULTIPLEXER_PRIORITY_HIGH
+
+var JSONRPC2DataStreamMultiplexerPriorities = []JSONRPC2DataStreamMultiplexerPriority{
+	JSONRPC2_MULTIPLEXER_PRIORITY_HIGH,
+	JSONRPC2_MULTIPLEXER_PRIORITY_NORMAL,
+	JSONRPC2_MULTIPLEXER_PRIORITY_BULK,
+}
+
+func (self JSONRPC2DataStreamMultiplexerPriority) String() string {
+	switch self {
+	case JSONRPC2_MULTIPLEXER_PRIORITY_BULK:
+		return "bulk"
+	case JSONRPC2_MULTIPLEXER_PRIORITY_NORMAL:
+		return "normal"
+	case JSONRPC2_MULTIPLEXER_PRIORITY_HIGH:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// values received from peer are clamped to known classes
+func (self JSONRPC2DataStreamMultiplexerPriority) Normalize() JSONRPC2DataStreamMultiplexerPriority {
+	switch {
+	case self < JSONRPC2_MULTIPLEXER_PRIORITY_BULK:
+		return JSONRPC2_MULTIPLEXER_PRIORITY_BULK
+	case self > JSONRPC2_MULTIPLEXER_PRIORITY_HIGH:
+		return JSONRPC2_MULTIPLEXER_PRIORITY_HIGH
+	default:
+		return self
+	}
+}
+
+// counting semaphore, which wakes waiters with higher priority first
+// (FIFO inside one priority class)
+type priorityGate struct {
+	mutex    sync.Mutex
+	capacity int
+	used     int
+	waiters  map[JSONRPC2DataStreamMultiplexerPriority][]chan struct{}
+}
+
+func newPriorityGate(capacity int) *priorityGate {
+	self := new(priorityGate)
+	if capacity < 1 {
+		capacity = 1
+	}
+	self.capacity = capacity
+	self.waiters = make(map[JSONRPC2DataStreamMultiplexerPriority][]chan struct{})
+	return self
+}
+
+func (self *priorityGate) Acquire(priority JSONRPC2DataStreamMultiplexerPriority) {
+	priority = priority.Normalize()
+
+	self.mutex.Lock()
+	if self.used < self.capacity && self.waitingCount() == 0 {
+		self.used++
+		self.mutex.Unlock()
+		return
+	}
+
+	c := make(chan struct{})
+	self.waiters[priority] = append(self.waiters[priority], c)
+	self.mutex.Unlock()
+
+	// slot is passed to us by Release()
+	<-c
+}
+
+func (self *priorityGate) Release() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, p := range JSONRPC2DataStreamMultiplexerPriorities {
+		w := self.waiters[p]
+		if len(w) != 0 {
+			self.waiters[p] = w[1:]
+			close(w[0])
+			return
+		}
+	}
+
+	self.used--
+}
+
+func (self *priorityGate) waitingCount() int {
+	ret := 0
+	for _, w := range self.waiters {
+		ret += len(w)
+	}
+	return ret
+}
+
+// what is known about response before it's sent
+type outgoingResponse struct {
+	priority JSONRPC2DataStreamMultiplexerPriority
+	// gbs response: carries slice data
+	slice bool
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) setResponsePriority(
+	request_id any,
+	priority JSONRPC2DataStreamMultiplexerPriority,
+	slice bool,
+) {
+	b, err := json.Marshal(request_id)
+	if err != nil {
+		return
+	}
+
+	self.priorities_mutex.Lock()
+	defer self.priorities_mutex.Unlock()
+
+	self.response_priorities[string(b)] = outgoingResponse{priority: priority, slice: slice}
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) setIncommingPriority(
+	buffid string,
+	priority JSONRPC2DataStreamMultiplexerPriority,
+) {
+	self.priorities_mutex.Lock()
+	defer self.priorities_mutex.Unlock()
+
+	self.incomming_priorities[buffid] = priority
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) delIncommingPriority(buffid string) {
+	self.priorities_mutex.Lock()
+	defer self.priorities_mutex.Unlock()
+
+	delete(self.incomming_priorities, buffid)
+}
+
+// decides priority of message about to be passed to PushMessageToOutsideCB.
+// slice is true for gbs responses: only they are paced by send limiter,
+// other messages are small control traffic
+func (self *JSONRPC2DataStreamMultiplexer) outgoingMessagePriority(
+	data []byte,
+) (priority JSONRPC2DataStreamMultiplexerPriority, slice bool) {
+
+	var m struct {
+		Id     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return JSONRPC2_MULTIPLEXER_PRIORITY_CONTROL, false
+	}
+
+	var buffid string
+
+	if len(m.Params) != 0 {
+		var p struct {
+			Id string `json:"id"`
+		}
+		err = json.Unmarshal(m.Params, &p)
+		if err == nil {
+			buffid = p.Id
+		}
+	}
+
+	switch m.Method {
+	case JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE:
+		bw, ok := self.getBuffByIdLocal(buffid)
+		if ok {
+			return bw.Priority, false
+		}
+
+	case JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO,
+		JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE:
+		self.priorities_mutex.Lock()
+		defer self.priorities_mutex.Unlock()
+
+		p, ok := self.incomming_priorities[buffid]
+		if ok {
+			return p, false
+		}
+
+	case "":
+		// response
+		if len(m.Id) != 0 {
+			self.priorities_mutex.Lock()
+			defer self.priorities_mutex.Unlock()
+
+			r, ok := self.response_priorities[string(m.Id)]
+			if ok {
+				delete(self.response_priorities, string(m.Id))
+				return r.priority, r.slice
+			}
+		}
+	}
+
+	return JSONRPC2_MULTIPLEXER_PRIORITY_CONTROL, false
+}
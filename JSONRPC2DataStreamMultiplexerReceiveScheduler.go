@@ -0,0 +1,325 @@
+package gojsonrpc2datastreammultiplexer
+
+// receive scheduler coordinates pull loops of incomming transfers
+// (each "n" announcement starts one).
+//
+// it caps count of concurrently pulled transfers (others wait in queue,
+// higher priority first) and distributes slice requests between active pulls
+// using smooth weighted round-robin, where weight depends on transfer
+// priority.
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_CONCURRENT_PULLS = 4
+)
+
+func receiveSchedulerWeight(priority JSONRPC2DataStreamMultiplexerPriority) int {
+	switch priority.Normalize() {
+	case JSONRPC2_MULTIPLEXER_PRIORITY_HIGH:
+		return 4
+	case JSONRPC2_MULTIPLEXER_PRIORITY_BULK:
+		return 1
+	default:
+		return 2
+	}
+}
+
+type JSONRPC2DataStreamMultiplexerReceiveSchedulerTransferState struct {
+	BufferId        string
+	Priority        JSONRPC2DataStreamMultiplexerPriority
+	Size            int64
+	WaitingForSlice bool
+	SlicesGranted   int64
+	// time of queueing (for queued transfers) or admission (for active)
+	Since time.Time
+}
+
+type JSONRPC2DataStreamMultiplexerReceiveSchedulerState struct {
+	MaxConcurrentPulls int
+	MaxSlicesInFlight  int
+	SlicesInFlight     int
+	Active             []JSONRPC2DataStreamMultiplexerReceiveSchedulerTransferState
+	Queued             []JSONRPC2DataStreamMultiplexerReceiveSchedulerTransferState
+}
+
+type receiveSchedulerTransfer struct {
+	buffid   string
+	priority JSONRPC2DataStreamMultiplexerPriority
+	size     int64
+	since    time.Time
+
+	admitted chan struct{}
+
+	// not nil while transfer waits for it's turn to request slice
+	slice_turn     chan struct{}
+	current_weight int
+	slices_granted int64
+}
+
+type JSONRPC2DataStreamMultiplexerReceiveScheduler struct {
+	mutex sync.Mutex
+
+	max_pulls  int
+	max_slices int
+
+	active           []*receiveSchedulerTransfer
+	queued           []*receiveSchedulerTransfer
+	slices_in_flight int
+
+	closed bool
+}
+
+func NewJSONRPC2DataStreamMultiplexerReceiveScheduler(
+	max_pulls int,
+	max_slices int,
+) *JSONRPC2DataStreamMultiplexerReceiveScheduler {
+	self := new(JSONRPC2DataStreamMultiplexerReceiveScheduler)
+	self.SetLimits(max_pulls, max_slices)
+	return self
+}
+
+// max_pulls - how many transfers are pulled simultaneously;
+// max_slices - how many slice requests (for all transfers in sum) are in flight.
+// values < 1 are treated as 1
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) SetLimits(
+	max_pulls int,
+	max_slices int,
+) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if max_pulls < 1 {
+		max_pulls = 1
+	}
+	if max_slices < 1 {
+		max_slices = 1
+	}
+
+	self.max_pulls = max_pulls
+	self.max_slices = max_slices
+
+	self.admit()
+	self.dispatch()
+}
+
+// blocks until transfer is allowed to be pulled.
+// if scheduler is closed, returns ErrClosed
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) beginPull(
+	buffid string,
+	priority JSONRPC2DataStreamMultiplexerPriority,
+	size int64,
+) (*receiveSchedulerTransfer, error) {
+
+	t := &receiveSchedulerTransfer{
+		buffid:   buffid,
+		priority: priority.Normalize(),
+		size:     size,
+		since:    time.Now(),
+		admitted: make(chan struct{}),
+	}
+
+	err := func() error {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		if self.closed {
+			return ErrClosed
+		}
+
+		// keep queue sorted by priority, FIFO inside one priority
+		i := len(self.queued)
+		for i != 0 && self.queued[i-1].priority < t.priority {
+			i--
+		}
+		self.queued = append(self.queued, nil)
+		copy(self.queued[i+1:], self.queued[i:])
+		self.queued[i] = t
+
+		self.admit()
+
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	<-t.admitted
+
+	if self.isClosed() {
+		self.endPull(t)
+		return nil, ErrClosed
+	}
+
+	return t, nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) endPull(t *receiveSchedulerTransfer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i, x := range self.active {
+		if x == t {
+			self.active = append(self.active[:i], self.active[i+1:]...)
+			break
+		}
+	}
+
+	self.admit()
+	self.dispatch()
+}
+
+// blocks until transfer's turn to request next slice.
+// each successful call must be followed by sliceDone()
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) waitSliceTurn(t *receiveSchedulerTransfer) error {
+	c := make(chan struct{})
+
+	err := func() error {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		if self.closed {
+			return ErrClosed
+		}
+
+		t.slice_turn = c
+		self.dispatch()
+
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	<-c
+
+	if self.isClosed() {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) sliceDone(t *receiveSchedulerTransfer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.slices_in_flight--
+	self.dispatch()
+}
+
+// wakes all waiting pulls. they get ErrClosed
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return
+	}
+
+	self.closed = true
+
+	for _, t := range self.queued {
+		close(t.admitted)
+	}
+	self.queued = nil
+
+	for _, t := range self.active {
+		if t.slice_turn != nil {
+			close(t.slice_turn)
+			t.slice_turn = nil
+		}
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) isClosed() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.closed
+}
+
+// must be called with mutex locked
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) admit() {
+	for len(self.active) < self.max_pulls && len(self.queued) != 0 {
+		t := self.queued[0]
+		self.queued = self.queued[1:]
+		t.since = time.Now()
+		self.active = append(self.active, t)
+		close(t.admitted)
+	}
+}
+
+// must be called with mutex locked
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) dispatch() {
+	for self.slices_in_flight < self.max_slices {
+
+		var (
+			selected     *receiveSchedulerTransfer
+			total_weight int
+		)
+
+		for _, t := range self.active {
+			if t.slice_turn == nil {
+				continue
+			}
+			w := receiveSchedulerWeight(t.priority)
+			t.current_weight += w
+			total_weight += w
+			if selected == nil || t.current_weight > selected.current_weight {
+				selected = t
+			}
+		}
+
+		if selected == nil {
+			return
+		}
+
+		selected.current_weight -= total_weight
+		selected.slices_granted++
+		self.slices_in_flight++
+
+		close(selected.slice_turn)
+		selected.slice_turn = nil
+	}
+}
+
+func (self *JSONRPC2DataStreamMultiplexerReceiveScheduler) QueueState() *JSONRPC2DataStreamMultiplexerReceiveSchedulerState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ret := new(JSONRPC2DataStreamMultiplexerReceiveSchedulerState)
+	ret.MaxConcurrentPulls = self.max_pulls
+	ret.MaxSlicesInFlight = self.max_slices
+	ret.SlicesInFlight = self.slices_in_flight
+
+	conv := func(t *receiveSchedulerTransfer) JSONRPC2DataStreamMultiplexerReceiveSchedulerTransferState {
+		return JSONRPC2DataStreamMultiplexerReceiveSchedulerTransferState{
+			BufferId:        t.buffid,
+			Priority:        t.priority,
+			Size:            t.size,
+			WaitingForSlice: t.slice_turn != nil,
+			SlicesGranted:   t.slices_granted,
+			Since:           t.since,
+		}
+	}
+
+	for _, t := range self.active {
+		ret.Active = append(ret.Active, conv(t))
+	}
+
+	for _, t := range self.queued {
+		ret.Queued = append(ret.Queued, conv(t))
+	}
+
+	return ret
+}
+
+// scheduler used for incomming transfers. can be used to tune limits
+// and inspect queue state
+func (self *JSONRPC2DataStreamMultiplexer) GetReceiveScheduler() *JSONRPC2DataStreamMultiplexerReceiveScheduler {
+	return self.receive_scheduler
+}
@@ -0,0 +1,123 @@
+package gojsonrpc2datastreammultiplexer
+
+// recent errors.
+//
+// every record multiplexer logs with Warn level or higher is also kept in
+// ring of last JSONRPC2_MULTIPLEXER_RECENT_ERRORS records, regardless of
+// logger set with SetLogger(). RecentErrors() returns them, oldest first.
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const JSONRPC2_MULTIPLEXER_RECENT_ERRORS = 64
+
+type JSONRPC2DataStreamMultiplexerErrorRecord struct {
+	Time    time.Time
+	Level   string
+	Message string
+	// structured fields of log record ("buffer_id", "err", ...)
+	Attrs map[string]string
+}
+
+type recentErrors struct {
+	mutex   sync.Mutex
+	records []JSONRPC2DataStreamMultiplexerErrorRecord
+	next    int
+	full    bool
+}
+
+func newRecentErrors(size int) *recentErrors {
+	self := new(recentErrors)
+	self.records = make([]JSONRPC2DataStreamMultiplexerErrorRecord, size)
+	return self
+}
+
+func (self *recentErrors) add(record JSONRPC2DataStreamMultiplexerErrorRecord) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.records[self.next] = record
+	self.next++
+	if self.next == len(self.records) {
+		self.next = 0
+		self.full = true
+	}
+}
+
+func (self *recentErrors) list() []JSONRPC2DataStreamMultiplexerErrorRecord {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ret := make([]JSONRPC2DataStreamMultiplexerErrorRecord, 0, len(self.records))
+	if self.full {
+		ret = append(ret, self.records[self.next:]...)
+	}
+	ret = append(ret, self.records[:self.next]...)
+	return ret
+}
+
+// passes records to 'next' and keeps Warn+ records in 'ring'
+type recentErrorsLogHandler struct {
+	next  slog.Handler
+	ring  *recentErrors
+	attrs []slog.Attr
+}
+
+func (self *recentErrorsLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || self.next.Enabled(ctx, level)
+}
+
+func (self *recentErrorsLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		attrs := make(map[string]string, len(self.attrs)+record.NumAttrs())
+		for _, a := range self.attrs {
+			attrs[a.Key] = a.Value.String()
+		}
+		record.Attrs(
+			func(a slog.Attr) bool {
+				attrs[a.Key] = a.Value.String()
+				return true
+			},
+		)
+		self.ring.add(
+			JSONRPC2DataStreamMultiplexerErrorRecord{
+				Time:    record.Time,
+				Level:   record.Level.String(),
+				Message: record.Message,
+				Attrs:   attrs,
+			},
+		)
+	}
+
+	if !self.next.Enabled(ctx, record.Level) {
+		return nil
+	}
+
+	return self.next.Handle(ctx, record)
+}
+
+func (self *recentErrorsLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recentErrorsLogHandler{
+		next:  self.next.WithAttrs(attrs),
+		ring:  self.ring,
+		attrs: append(append([]slog.Attr(nil), self.attrs...), attrs...),
+	}
+}
+
+// note: groups are not reflected in recorded Attrs
+func (self *recentErrorsLogHandler) WithGroup(name string) slog.Handler {
+	return &recentErrorsLogHandler{
+		next:  self.next.WithGroup(name),
+		ring:  self.ring,
+		attrs: self.attrs,
+	}
+}
+
+// last errors and warnings, oldest first
+func (self *JSONRPC2DataStreamMultiplexer) RecentErrors() []JSONRPC2DataStreamMultiplexerErrorRecord {
+	return self.recent_errors.list()
+}
@@ -0,0 +1,215 @@
+package gojsonrpc2datastreammultiplexer
+
+// protocol message recorder.
+//
+// if JSONRPC2DataStreamMultiplexer.Recorder is set, every message passed to
+// PushMessageToOutsideCB ("out") and to PushMessageFromOutside() ("in") is
+// written to recorder as one JSON line:
+//
+//	{"t":"2023-07-26T00:32:12.123456789Z","d":"in","m":"eyJqc29ucnBjIjoiMi4wIiwi..."}
+//
+// "m" is message's bytes in base64, so message is kept byte-exact, whatever
+// it contains (invalid JSON, JSON string, whitespace, etc.).
+//
+// recording can be replayed with cmd/jrpcmuxreplay and printed with
+// cmd/jrpcmuxdump.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_RECORD_IN  = "in"
+	JSONRPC2_MULTIPLEXER_RECORD_OUT = "out"
+)
+
+// maximum length of one recording line accepted by RecordReader
+const JSONRPC2_MULTIPLEXER_RECORD_MAX_LINE = 16 * JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE
+
+type JSONRPC2DataStreamMultiplexerRecord struct {
+	Time time.Time
+	// JSONRPC2_MULTIPLEXER_RECORD_IN or JSONRPC2_MULTIPLEXER_RECORD_OUT
+	Direction string
+	Data      []byte
+}
+
+type jsonRecord struct {
+	T time.Time `json:"t"`
+	D string    `json:"d"`
+	// encoded by encoding/json as base64
+	M []byte `json:"m"`
+}
+
+func (self JSONRPC2DataStreamMultiplexerRecord) MarshalJSON() ([]byte, error) {
+	r := jsonRecord{
+		T: self.Time,
+		D: self.Direction,
+		M: self.Data,
+	}
+
+	// nil would be encoded as null
+	if r.M == nil {
+		r.M = []byte{}
+	}
+
+	return json.Marshal(r)
+}
+
+func (self *JSONRPC2DataStreamMultiplexerRecord) UnmarshalJSON(data []byte) error {
+	var r jsonRecord
+
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		return err
+	}
+
+	switch r.D {
+	case JSONRPC2_MULTIPLEXER_RECORD_IN, JSONRPC2_MULTIPLEXER_RECORD_OUT:
+	default:
+		return errors.New("invalid 'd' value")
+	}
+
+	if r.M == nil {
+		return errors.New("'m' is missing")
+	}
+
+	self.Time = r.T
+	self.Direction = r.D
+	self.Data = r.M
+
+	return nil
+}
+
+type JSONRPC2DataStreamMultiplexerRecorder struct {
+	mutex sync.Mutex
+	w     io.Writer
+	err   error
+}
+
+// records are written to 'w' as they come. 'w' isn't closed by recorder.
+// recorder can be shared by several multiplexers, but then it's
+// impossible to tell which record belongs to which multiplexer
+func NewJSONRPC2DataStreamMultiplexerRecorder(w io.Writer) *JSONRPC2DataStreamMultiplexerRecorder {
+	self := new(JSONRPC2DataStreamMultiplexerRecorder)
+	self.w = w
+	return self
+}
+
+// after first write error recorder stops recording. see Err()
+func (self *JSONRPC2DataStreamMultiplexerRecorder) Record(direction string, data []byte) error {
+	b, err := JSONRPC2DataStreamMultiplexerRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Data:      data,
+	}.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.err != nil {
+		return self.err
+	}
+
+	_, self.err = self.w.Write(b)
+
+	return self.err
+}
+
+// first write error
+func (self *JSONRPC2DataStreamMultiplexerRecorder) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.err
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) record(direction string, data []byte) {
+	if self.Recorder == nil {
+		return
+	}
+
+	err := self.Recorder.Record(direction, data)
+	if err != nil && self.debug {
+		self.DebugPrintln("can't record message:", err)
+	}
+}
+
+// reads recording, written by JSONRPC2DataStreamMultiplexerRecorder
+type JSONRPC2DataStreamMultiplexerRecordReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewJSONRPC2DataStreamMultiplexerRecordReader(r io.Reader) *JSONRPC2DataStreamMultiplexerRecordReader {
+	self := new(JSONRPC2DataStreamMultiplexerRecordReader)
+	self.scanner = bufio.NewScanner(r)
+	self.scanner.Buffer(nil, JSONRPC2_MULTIPLEXER_RECORD_MAX_LINE)
+	return self
+}
+
+// returns io.EOF after last record. empty lines are skipped
+func (self *JSONRPC2DataStreamMultiplexerRecordReader) Read() (*JSONRPC2DataStreamMultiplexerRecord, error) {
+	for self.scanner.Scan() {
+		self.line++
+
+		line := self.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		ret := new(JSONRPC2DataStreamMultiplexerRecord)
+		err := json.Unmarshal(line, ret)
+		if err != nil {
+			return nil, &JSONRPC2DataStreamMultiplexerRecordError{Line: self.line, Err: err}
+		}
+
+		return ret, nil
+	}
+
+	err := self.scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+type JSONRPC2DataStreamMultiplexerRecordError struct {
+	Line int
+	Err  error
+}
+
+func (self *JSONRPC2DataStreamMultiplexerRecordError) Error() string {
+	return "recording line " + strconv.Itoa(self.Line) + ": " + self.Err.Error()
+}
+
+func (self *JSONRPC2DataStreamMultiplexerRecordError) Unwrap() error {
+	return self.Err
+}
+
+// reads all records
+func ReadJSONRPC2DataStreamMultiplexerRecording(r io.Reader) ([]*JSONRPC2DataStreamMultiplexerRecord, error) {
+	reader := NewJSONRPC2DataStreamMultiplexerRecordReader(r)
+
+	var ret []*JSONRPC2DataStreamMultiplexerRecord
+	for {
+		rec, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return ret, nil
+			}
+			return ret, err
+		}
+		ret = append(ret, rec)
+	}
+}
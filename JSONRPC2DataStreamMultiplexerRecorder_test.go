@@ -0,0 +1,52 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecordingRoundTrip(t *testing.T) {
+	messages := []struct {
+		direction string
+		data      []byte
+	}{
+		{JSONRPC2_MULTIPLEXER_RECORD_OUT, []byte(`{"jsonrpc":"2.0","method":"n","params":{"id":"abc"},"id":1}`)},
+		// valid JSON, but not object: must not be confused with raw bytes
+		{JSONRPC2_MULTIPLEXER_RECORD_IN, []byte(`"abc"`)},
+		// whitespace and html characters must be kept as is
+		{JSONRPC2_MULTIPLEXER_RECORD_IN, []byte("{ \"a\" : \"<&>\" }\n")},
+		{JSONRPC2_MULTIPLEXER_RECORD_OUT, []byte{0xff, 0x00, '{'}},
+		{JSONRPC2_MULTIPLEXER_RECORD_IN, []byte{}},
+	}
+
+	b := new(bytes.Buffer)
+	recorder := NewJSONRPC2DataStreamMultiplexerRecorder(b)
+
+	for _, m := range messages {
+		err := recorder.Record(m.direction, m.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := ReadJSONRPC2DataStreamMultiplexerRecording(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != len(messages) {
+		t.Fatalf("%d records read back, %d recorded", len(records), len(messages))
+	}
+
+	for i, m := range messages {
+		if records[i].Direction != m.direction {
+			t.Errorf("#%d: direction %q, recorded %q", i, records[i].Direction, m.direction)
+		}
+		if !bytes.Equal(records[i].Data, m.data) {
+			t.Errorf("#%d: data %q, recorded %q", i, records[i].Data, m.data)
+		}
+		if records[i].Time.IsZero() {
+			t.Errorf("#%d: no time", i)
+		}
+	}
+}
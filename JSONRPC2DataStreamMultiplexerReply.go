@@ -0,0 +1,190 @@
+package gojsonrpc2datastreammultiplexer
+
+// application-level replies on channelled buffers.
+//
+// ChannelDataWithReply() / ChannelDataReaderWithReply() announce buffer with
+// "w" (wants reply) flag. receiver, after pulling buffer, passes it to
+// OnIncommingDataTransferReplyCB (instead of OnIncommingDataTransferComplete)
+// and channels returned reply back, announcing it with "rt" (reply to) field
+// set to id of original buffer. sender delivers pulled reply to the waiting
+// call instead of OnIncommingDataTransferComplete.
+//
+// receiver confirms transfer ("tc") before calling
+// OnIncommingDataTransferReplyCB, so ReplyTimeout counts time it takes. if it
+// fails (or isn't set), receiver sends "tf" and sender's call fails with
+// ErrTransferFailed.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrReplyTimeout = errors.New("timeout waiting for peer to reply")
+
+type transferReply struct {
+	data io.WriteSeeker
+	err  error
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) replyTimeout(
+	options *JSONRPC2DataStreamMultiplexerChannelDataOptions,
+) time.Duration {
+	if options.ReplyTimeout > 0 {
+		return options.ReplyTimeout
+	}
+	return JSONRPC2_MULTIPLEXER_ANNOUNCEMENT_TIMEOUT
+}
+
+// same as ChannelData, but waits for peer's reply
+// (see OnIncommingDataTransferReplyCB) and returns it
+func (self *JSONRPC2DataStreamMultiplexer) ChannelDataWithReply(data []byte) (
+	timedout bool,
+	closed bool,
+	reply []byte,
+	proto_err error,
+	err error,
+) {
+	timedout, closed, reply_ws, proto_err, err :=
+		self.ChannelDataReaderWithReply(bytes.NewReader(data), nil)
+	if timedout || closed || proto_err != nil || err != nil {
+		return timedout, closed, nil, proto_err, err
+	}
+
+	reply, err = readWriteSeeker(reply_ws)
+	if err != nil {
+		return false, false, nil, nil, err
+	}
+
+	return false, false, reply, nil, nil
+}
+
+// same as ChannelDataReaderWithOptions, but waits for peer's reply
+// (see OnIncommingDataTransferReplyCB) and returns it. reply is written to
+// WriteSeeker provided by OnRequestToProvideWriteSeekerCB.
+// 'options' may be nil
+func (self *JSONRPC2DataStreamMultiplexer) ChannelDataReaderWithReply(
+	data io.ReadSeeker,
+	options *JSONRPC2DataStreamMultiplexerChannelDataOptions,
+) (
+	timedout bool,
+	closed bool,
+	reply io.WriteSeeker,
+	proto_err error,
+	err error,
+) {
+	var o JSONRPC2DataStreamMultiplexerChannelDataOptions
+	if options != nil {
+		o = *options
+	}
+	o.wants_reply = true
+	o.reply_to = ""
+
+	timedout, closed, _, reply, proto_err, err = self.channelDataReader(data, &o)
+	return timedout, closed, reply, proto_err, err
+}
+
+// waits for reply after peer received buffer
+func (self *JSONRPC2DataStreamMultiplexer) waitReply(
+	wrapper *JSONRPC2DataStreamMultiplexerBufferWrapper,
+	timeout time.Duration,
+) (
+	timedout bool,
+	closed bool,
+	reply io.WriteSeeker,
+	err error,
+) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	peer_lost_chan := self.getPeerLostChan()
+
+	// peer starts to channel reply
+	select {
+	case <-wrapper.reply_started:
+	case msg := <-wrapper.reply_failed:
+		reason := ""
+		msg_par, ok := (msg.Params).(map[string]any)
+		if ok {
+			reason, _ = msg_par["r"].(string)
+		}
+		self.logger.Warn("peer failed to reply", "buffer_id", wrapper.BufferId, "reason", reason)
+		return false, false, nil, fmt.Errorf("%w: %s", ErrTransferFailed, reason)
+	case <-timer.C:
+		return true, false, nil, ErrReplyTimeout
+	case <-peer_lost_chan:
+		return false, false, nil, ErrPeerLost
+	case <-self.closed_chan:
+		return false, true, nil, ErrClosed
+	}
+
+	if self.debug {
+		self.DebugPrintln("peer started to channel reply for", wrapper.BufferId)
+	}
+
+	// pull of the reply has own timeouts
+	select {
+	case r := <-wrapper.reply:
+		return false, false, r.data, r.err
+	case <-peer_lost_chan:
+		return false, false, nil, ErrPeerLost
+	case <-self.closed_chan:
+		return false, true, nil, ErrClosed
+	}
+}
+
+// finds buffer waiting for reply
+func (self *JSONRPC2DataStreamMultiplexer) getReplyWaiter(
+	reply_to string,
+) (*JSONRPC2DataStreamMultiplexerBufferWrapper, error) {
+	wrapper, ok := self.getBuffByIdLocal(reply_to)
+	if !ok || wrapper.reply == nil {
+		return nil, errors.New("reply to buffer, which doesn't wait for reply")
+	}
+
+	select {
+	case wrapper.reply_started <- struct{}{}:
+	default:
+		return nil, errors.New("buffer already got reply")
+	}
+
+	return wrapper, nil
+}
+
+// passes received data to OnIncommingDataTransferReplyCB and returns reply
+func (self *JSONRPC2DataStreamMultiplexer) makeReply(
+	data io.WriteSeeker,
+) (io.ReadSeeker, error) {
+	if self.OnIncommingDataTransferReplyCB == nil {
+		return nil, errors.New("replies are not supported by peer")
+	}
+
+	reply, err := self.OnIncommingDataTransferReplyCB(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply == nil {
+		return nil, errors.New("peer returned no reply")
+	}
+
+	return reply, nil
+}
+
+// channels reply on incomming buffer 'buffid' back to peer
+func (self *JSONRPC2DataStreamMultiplexer) sendReply(
+	buffid string,
+	priority JSONRPC2DataStreamMultiplexerPriority,
+	reply io.ReadSeeker,
+) {
+	o := new(JSONRPC2DataStreamMultiplexerChannelDataOptions)
+	o.Priority = priority
+	o.reply_to = buffid
+
+	timedout, closed, _, _, proto_err, err := self.channelDataReader(reply, o)
+	if self.debug && (timedout || closed || proto_err != nil || err != nil) {
+		self.DebugPrintln("couldn't channel reply on", buffid, ":", timedout, closed, proto_err, err)
+	}
+}
@@ -0,0 +1,104 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplyMatchedToRequest(t *testing.T) {
+	const transfers = 5
+
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{
+			Latency: time.Millisecond,
+			Jitter:  2 * time.Millisecond,
+		},
+	)
+	defer p.Close()
+
+	// reply is reversed request, so each caller can check, it got own reply
+	p.B.OnIncommingDataTransferReplyCB = func(ws io.WriteSeeker) (io.ReadSeeker, error) {
+		data := readAllWriteSeeker(t, ws)
+		for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	p.A.OnIncommingDataTransferComplete = func(io.WriteSeeker) {
+		t.Error("reply passed to OnIncommingDataTransferComplete")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i != transfers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			data := testData(3*JSONRPC2_MULTIPLEXER_SLICE_SIZE+i, byte(i))
+
+			timedout, closed, reply, proto_err, err := p.A.ChannelDataWithReply(data)
+			if timedout || closed || proto_err != nil || err != nil {
+				t.Errorf("transfer %d: %v %v %v %v", i, timedout, closed, proto_err, err)
+				return
+			}
+
+			for j := range data {
+				if reply[len(reply)-1-j] != data[j] {
+					t.Errorf("transfer %d got wrong reply", i)
+					return
+				}
+			}
+		}(i)
+	}
+
+	waitGroupTimeout(t, &wg, 10*time.Second)
+}
+
+func TestReplyTimeout(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	p.B.OnIncommingDataTransferReplyCB = func(ws io.WriteSeeker) (io.ReadSeeker, error) {
+		<-release
+		return bytes.NewReader([]byte("late")), nil
+	}
+
+	started := time.Now()
+
+	timedout, _, _, _, err := p.A.ChannelDataReaderWithReply(
+		bytes.NewReader(testData(100, 0)),
+		&JSONRPC2DataStreamMultiplexerChannelDataOptions{
+			ReplyTimeout: 200 * time.Millisecond,
+		},
+	)
+	if !timedout || !errors.Is(err, ErrReplyTimeout) {
+		t.Fatal("expected ErrReplyTimeout, got", timedout, err)
+	}
+
+	if time.Since(started) > 5*time.Second {
+		t.Fatal("reply timeout fired too late:", time.Since(started))
+	}
+}
+
+func TestReplyCallbackFailure(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	p.B.OnIncommingDataTransferReplyCB = func(ws io.WriteSeeker) (io.ReadSeeker, error) {
+		return nil, errors.New("can't answer")
+	}
+
+	_, _, _, _, err := p.A.ChannelDataWithReply(testData(100, 0))
+	if !errors.Is(err, ErrTransferFailed) || !strings.Contains(err.Error(), "can't answer") {
+		t.Fatal("expected ErrTransferFailed with reason, got", err)
+	}
+}
@@ -0,0 +1,231 @@
+package gojsonrpc2datastreammultiplexer
+
+// retry and timeout policy for requests made by JSONRPC2DataStreamMultiplexer
+// (gbi, gbs, handshake).
+//
+// timeout of request is derived from measured round trip time (like TCP's RTO,
+// RFC 6298) and is doubled on each next attempt. if peer is expected to
+// delay response by rate limiting (gbs of rate limited transfer), this delay
+// is added to timeout. between attempts
+// JSONRPC2DataStreamMultiplexer waits using exponential backoff with jitter.
+// only known transient failures are retried: timeouts and failures to send
+// request (ErrRequestNotSent, io.ErrClosedPipe). anything else (protocol
+// errors, closing or shutdown of either side, loss of peer, failed
+// authentication, expired buffers and errors added later) is not.
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// request wasn't passed to PushMessageToOutsideCB or it failed. wraps
+// error of sending
+var ErrRequestNotSent = errors.New("request not sent")
+
+type JSONRPC2DataStreamMultiplexerRetryPolicy struct {
+	// total count of attempts, including first one. values < 1 are treated as 1
+	Attempts int
+
+	// delay before second attempt
+	InitialBackoff time.Duration
+	// delay is multiplied by BackoffMultiplier for each next attempt
+	BackoffMultiplier float64
+	MaxBackoff        time.Duration
+	// 0..1 - delay is randomly changed by up to Jitter*delay in both directions
+	Jitter float64
+
+	// request timeout used while RTT isn't measured yet
+	InitialTimeout time.Duration
+	// bounds of RTT derived timeout
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+}
+
+func DefaultJSONRPC2DataStreamMultiplexerRetryPolicy() *JSONRPC2DataStreamMultiplexerRetryPolicy {
+	return &JSONRPC2DataStreamMultiplexerRetryPolicy{
+		Attempts:          4,
+		InitialBackoff:    100 * time.Millisecond,
+		BackoffMultiplier: 2,
+		MaxBackoff:        10 * time.Second,
+		Jitter:            0.2,
+		InitialTimeout:    time.Minute,
+		MinTimeout:        time.Second,
+		MaxTimeout:        time.Minute,
+	}
+}
+
+// delay before attempt number attempt+1
+func (self *JSONRPC2DataStreamMultiplexerRetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	mult := self.BackoffMultiplier
+	if mult < 1 {
+		mult = 1
+	}
+
+	d := float64(self.InitialBackoff) * math.Pow(mult, float64(attempt-1))
+	if self.MaxBackoff > 0 && d > float64(self.MaxBackoff) {
+		d = float64(self.MaxBackoff)
+	}
+
+	jitter := math.Min(math.Max(self.Jitter, 0), 1)
+	d += d * jitter * (rand.Float64()*2 - 1)
+
+	return time.Duration(d)
+}
+
+// timeouts and failures to send request are retryable. protocol errors
+// (peer answered, but answer is wrong), unknown errors and errors, which
+// won't go away by repeating (closing, shutdown, loss of peer,
+// authentication, expired buffer) - are not. failure to send is permanent
+// too, if it's caused by one of the latter
+func (self *JSONRPC2DataStreamMultiplexerRetryPolicy) IsRetryable(
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) bool {
+	if closed || proto_err != nil {
+		return false
+	}
+
+	for _, e := range []error{
+		ErrClosed,
+		ErrShuttingDown,
+		ErrPeerLost,
+		ErrPeerGoingAway,
+		ErrPeerNotAuthenticated,
+		ErrBufferExpired,
+	} {
+		if errors.Is(err, e) {
+			return false
+		}
+	}
+
+	return timedout ||
+		errors.Is(err, ErrRequestNotSent) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
+
+// timeout for attempt number 'attempt' (counting from 1), based on
+// smoothed round trip time
+func (self *JSONRPC2DataStreamMultiplexerRetryPolicy) Timeout(
+	srtt time.Duration,
+	rttvar time.Duration,
+	measured bool,
+	attempt int,
+) time.Duration {
+
+	var ret time.Duration
+
+	if measured {
+		ret = srtt + 4*rttvar
+	} else {
+		ret = self.InitialTimeout
+	}
+
+	for i := 1; i < attempt; i++ {
+		ret *= 2
+		if self.MaxTimeout > 0 && ret > self.MaxTimeout {
+			break
+		}
+	}
+
+	if ret < self.MinTimeout {
+		ret = self.MinTimeout
+	}
+
+	if self.MaxTimeout > 0 && ret > self.MaxTimeout {
+		ret = self.MaxTimeout
+	}
+
+	return ret
+}
+
+// RFC 6298 smoothed RTT
+type rttEstimator struct {
+	mutex    sync.Mutex
+	srtt     time.Duration
+	rttvar   time.Duration
+	measured bool
+}
+
+func (self *rttEstimator) Update(sample time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.measured {
+		self.srtt = sample
+		self.rttvar = sample / 2
+		self.measured = true
+		return
+	}
+
+	delta := self.srtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+
+	self.rttvar = (3*self.rttvar + delta) / 4
+	self.srtt = (7*self.srtt + sample) / 8
+}
+
+func (self *rttEstimator) Get() (srtt time.Duration, rttvar time.Duration, measured bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.srtt, self.rttvar, self.measured
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) getRetryPolicy() *JSONRPC2DataStreamMultiplexerRetryPolicy {
+	ret := self.RetryPolicy
+	if ret == nil {
+		ret = DefaultJSONRPC2DataStreamMultiplexerRetryPolicy()
+	}
+
+	if ret.Attempts < 1 {
+		x := *ret
+		x.Attempts = 1
+		ret = &x
+	}
+
+	return ret
+}
+
+// smoothed round trip time to peer. ok is false, if it isn't measured yet
+func (self *JSONRPC2DataStreamMultiplexer) RTT() (rtt time.Duration, ok bool) {
+	srtt, _, measured := self.rtt_estimator.Get()
+	return srtt, measured
+}
+
+// timeout != 0 - explicitly requested timeout, returned as is.
+// pacing is added to derived timeout after applying
+// MinTimeout and MaxTimeout: it's not part of round trip
+func (self *JSONRPC2DataStreamMultiplexer) requestTimeout(
+	timeout time.Duration,
+	pacing time.Duration,
+	attempt int,
+) time.Duration {
+	if timeout != 0 {
+		return timeout
+	}
+
+	srtt, rttvar, measured := self.rtt_estimator.Get()
+
+	return self.getRetryPolicy().Timeout(srtt, rttvar, measured, attempt) + pacing
+}
+
+// time needed to pass 'size' bytes at 'rate' bytes per second.
+// rate <= 0 - no limit
+func pacingDelay(size int64, rate int64) time.Duration {
+	if rate <= 0 || size <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(rate) * float64(time.Second))
+}
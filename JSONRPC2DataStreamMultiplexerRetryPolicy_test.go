@@ -0,0 +1,76 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	policy := DefaultJSONRPC2DataStreamMultiplexerRetryPolicy()
+
+	for _, c := range []struct {
+		timedout  bool
+		closed    bool
+		proto_err error
+		err       error
+		expected  bool
+	}{
+		{true, false, nil, errors.New("timeout"), true},
+		{false, false, nil, fmt.Errorf("%w: %w", ErrRequestNotSent, errors.New("can't send")), true},
+		{false, false, nil, io.ErrClosedPipe, true},
+		{false, false, nil, fmt.Errorf("%w: %w", ErrRequestNotSent, ErrClosed), false},
+		// unknown errors are permanent
+		{false, false, nil, errors.New("something new"), false},
+		{false, false, nil, nil, false},
+		{false, true, nil, ErrClosed, false},
+		{false, false, errors.New("bad response"), errors.New("protocol error"), false},
+		{false, false, nil, ErrClosed, false},
+		{false, false, nil, ErrShuttingDown, false},
+		{false, false, nil, ErrPeerLost, false},
+		{false, false, nil, ErrPeerGoingAway, false},
+		{false, false, nil, ErrPeerNotAuthenticated, false},
+		{false, false, nil, ErrBufferExpired, false},
+		{false, false, nil, fmt.Errorf("slice: %w", ErrBufferExpired), false},
+	} {
+		r := policy.IsRetryable(c.timedout, c.closed, c.proto_err, c.err)
+		if r != c.expected {
+			t.Errorf("IsRetryable(%v, %v, %v, %v) = %v", c.timedout, c.closed, c.proto_err, c.err, r)
+		}
+	}
+}
+
+func TestRequestTimeoutPacing(t *testing.T) {
+	mux := NewJSONRPC2DataStreamMultiplexer()
+	defer mux.Close()
+
+	policy := DefaultJSONRPC2DataStreamMultiplexerRetryPolicy()
+	mux.RetryPolicy = policy
+
+	mux.rtt_estimator.Update(10 * time.Millisecond)
+
+	// slice at 100 bytes per second
+	pacing := pacingDelay(JSONRPC2_MULTIPLEXER_SLICE_SIZE, 100)
+	if pacing != JSONRPC2_MULTIPLEXER_SLICE_SIZE*10*time.Millisecond {
+		t.Fatal("unexpected pacing delay:", pacing)
+	}
+
+	if d := mux.requestTimeout(0, 0, 1); d != policy.MinTimeout {
+		t.Fatal("unexpected timeout without pacing:", d)
+	}
+
+	if d := mux.requestTimeout(0, pacing, 1); d != policy.MinTimeout+pacing {
+		t.Fatal("pacing not added to timeout:", d)
+	}
+
+	// explicit timeout is used as is
+	if d := mux.requestTimeout(time.Second, pacing, 1); d != time.Second {
+		t.Fatal("explicit timeout changed:", d)
+	}
+
+	if pacingDelay(JSONRPC2_MULTIPLEXER_SLICE_SIZE, 0) != 0 {
+		t.Fatal("pacing delay without limit")
+	}
+}
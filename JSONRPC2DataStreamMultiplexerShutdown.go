@@ -0,0 +1,165 @@
+package gojsonrpc2datastreammultiplexer
+
+// graceful shutdown.
+//
+// Shutdown() stops accepting new ChannelData* calls and incomming "n"
+// announcements, notifies peer with "ga" (goaway) request, waits for transfers
+// in progress (both directions) to finish and only then closes jrpc node.
+//
+// peer, which received "ga", refuses new ChannelData* calls with
+// ErrPeerGoingAway, but lets transfers in progress finish.
+//
+// after Close() (which is also the last step of Shutdown()) public methods
+// return ErrClosed.
+
+import (
+	"context"
+	"errors"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_METHOD_GOAWAY = "ga"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_ERROR_CODE_GOING_AWAY = -32003
+)
+
+var (
+	ErrClosed        = errors.New("multiplexer is closed")
+	ErrShuttingDown  = errors.New("multiplexer is shutting down")
+	ErrPeerGoingAway = errors.New("peer is going away")
+)
+
+// if ctx expires before transfers in progress are finished, multiplexer is
+// closed anyway and ctx.Err() is returned
+func (self *JSONRPC2DataStreamMultiplexer) Shutdown(ctx context.Context) error {
+
+	closed, already := func() (bool, bool) {
+		self.state_mutex.Lock()
+		defer self.state_mutex.Unlock()
+
+		ret := self.shutting_down
+		self.shutting_down = true
+		return self.closed, ret
+	}()
+
+	if closed {
+		return ErrClosed
+	}
+
+	if already {
+		return ErrShuttingDown
+	}
+
+	if self.debug {
+		self.DebugPrintln("Shutdown: notifying peer")
+	}
+	self.logger.Info("shutting down")
+
+	{
+		m := new(gojsonrpc2.Message)
+		m.Method = JSONRPC2_MULTIPLEXER_METHOD_GOAWAY
+		m.Params = map[string]any{}
+
+		// peer may be already gone - that's not a reason not to shutdown
+		_, _, _, proto_err, err :=
+			self.requestSendingRespWaitingRoutine(m, nil, 0, 0, false, nil, nil)
+		if self.debug && (proto_err != nil || err != nil) {
+			self.DebugPrintln("Shutdown: peer not notified:", proto_err, err)
+		}
+	}
+
+	if self.debug {
+		self.DebugPrintln("Shutdown: waiting for transfers in progress")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		self.inflight_transfers.Wait()
+		close(drained)
+	}()
+
+	var ret error
+
+	select {
+	case <-drained:
+	case <-self.closed_chan:
+		// closed by someone else while draining
+	case <-ctx.Done():
+		ret = ctx.Err()
+		self.logger.Warn("shutdown: transfers not finished", "err", ret)
+		if self.debug {
+			self.DebugPrintln("Shutdown: transfers not finished:", ret)
+		}
+	}
+
+	self.Close()
+
+	return ret
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) isClosed() bool {
+	self.state_mutex.Lock()
+	defer self.state_mutex.Unlock()
+
+	return self.closed
+}
+
+// registers transfer (in any direction) in progress. Shutdown() waits for
+// all registered transfers. must be followed by endTransfer()
+func (self *JSONRPC2DataStreamMultiplexer) beginTransfer() error {
+	self.state_mutex.Lock()
+	defer self.state_mutex.Unlock()
+
+	if self.closed {
+		return ErrClosed
+	}
+
+	if self.shutting_down {
+		return ErrShuttingDown
+	}
+
+	self.inflight_transfers.Add(1)
+
+	return nil
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) endTransfer() {
+	self.inflight_transfers.Done()
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) isPeerGoingAway() bool {
+	self.state_mutex.Lock()
+	defer self.state_mutex.Unlock()
+
+	return self.peer_going_away
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_GOAWAY(msg *gojsonrpc2.Message) (
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	if self.debug {
+		self.DebugPrintln("jrpcOnRequestCB_GOAWAY: peer is going away")
+	}
+	self.logger.Info("peer is going away", "peer", self.GetPeerIdentity())
+
+	func() {
+		self.state_mutex.Lock()
+		defer self.state_mutex.Unlock()
+
+		self.peer_going_away = true
+	}()
+
+	err = self.sendResult(msg, map[string]any{})
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	return false, false, nil, nil
+}
@@ -0,0 +1,151 @@
+package gojsonrpc2datastreammultiplexer
+
+// bandwidth limiting.
+//
+// JSONRPC2DataStreamMultiplexer can be limited globally:
+//   - SetSendRateLimit() - slices sent to peer (gbs responses). control
+//     messages (pi, ga, tc, tf, handshake, requests and other responses)
+//     are small and aren't limited, so they aren't delayed behind slices;
+//   - SetReceiveRateLimit() - pacing of slice requests for all incomming
+//     transfers.
+//
+// and per transfer, using JSONRPC2DataStreamMultiplexerChannelDataOptions.RateLimit:
+// sender applies it to gbs responses of the buffer, and announces it to
+// receiver in "n" request, so receiver paces slice requests of this transfer
+// accordingly.
+
+import (
+	"sync"
+	"time"
+)
+
+// token bucket. nil *JSONRPC2DataStreamMultiplexerTokenBucket is valid
+// and means "no limit"
+type JSONRPC2DataStreamMultiplexerTokenBucket struct {
+	mutex sync.Mutex
+
+	rate  float64 // bytes per second
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// bytes_per_second <= 0 - no limit (nil is returned).
+// burst <= 0 - one second worth of data
+func NewJSONRPC2DataStreamMultiplexerTokenBucket(
+	bytes_per_second int64,
+	burst int64,
+) *JSONRPC2DataStreamMultiplexerTokenBucket {
+	if bytes_per_second <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = bytes_per_second
+	}
+
+	self := new(JSONRPC2DataStreamMultiplexerTokenBucket)
+	self.rate = float64(bytes_per_second)
+	self.burst = float64(burst)
+	self.tokens = self.burst
+	self.last = time.Now()
+	return self
+}
+
+func (self *JSONRPC2DataStreamMultiplexerTokenBucket) Rate() int64 {
+	if self == nil {
+		return 0
+	}
+	return int64(self.rate)
+}
+
+// how long caller have to wait before sending n bytes. tokens are taken
+// immediately (bucket may go into debt), so concurrent callers are served
+// in order of calling
+func (self *JSONRPC2DataStreamMultiplexerTokenBucket) Reserve(n int64) time.Duration {
+	if self == nil || n <= 0 {
+		return 0
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+	self.last = now
+
+	self.tokens -= float64(n)
+
+	if self.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
+
+// blocks until n bytes can be sent
+func (self *JSONRPC2DataStreamMultiplexerTokenBucket) Wait(n int64) {
+	d := self.Reserve(n)
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// same as Wait, but returns false (without waiting to the end) if 'cancel'
+// is closed
+func (self *JSONRPC2DataStreamMultiplexerTokenBucket) WaitCancelable(
+	n int64,
+	cancel <-chan struct{},
+) bool {
+	d := self.Reserve(n)
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// limit slices sent to peer (see header of this file).
+// bytes_per_second <= 0 removes the limit
+func (self *JSONRPC2DataStreamMultiplexer) SetSendRateLimit(bytes_per_second int64, burst int64) {
+	self.limits_mutex.Lock()
+	defer self.limits_mutex.Unlock()
+
+	self.send_limiter = NewJSONRPC2DataStreamMultiplexerTokenBucket(bytes_per_second, burst)
+}
+
+// limit rate of slice requests for all incomming transfers.
+// bytes_per_second <= 0 removes the limit
+func (self *JSONRPC2DataStreamMultiplexer) SetReceiveRateLimit(bytes_per_second int64, burst int64) {
+	self.limits_mutex.Lock()
+	defer self.limits_mutex.Unlock()
+
+	self.receive_limiter = NewJSONRPC2DataStreamMultiplexerTokenBucket(bytes_per_second, burst)
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) getSendLimiter() *JSONRPC2DataStreamMultiplexerTokenBucket {
+	self.limits_mutex.Lock()
+	defer self.limits_mutex.Unlock()
+
+	return self.send_limiter
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) getReceiveLimiter() *JSONRPC2DataStreamMultiplexerTokenBucket {
+	self.limits_mutex.Lock()
+	defer self.limits_mutex.Unlock()
+
+	return self.receive_limiter
+}
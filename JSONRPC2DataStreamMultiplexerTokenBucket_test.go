@@ -0,0 +1,95 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gbs response with id, as sent by multiplexer
+func testSliceResponse(mux *JSONRPC2DataStreamMultiplexer, id int, size int) []byte {
+	mux.setResponsePriority(id, JSONRPC2_MULTIPLEXER_PRIORITY_BULK, true)
+	return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":{"data":"%s"}}`, id, strings.Repeat("A", size)))
+}
+
+// Close() must interrupt sends, sleeping in send limiter
+func TestCloseInterruptsRateLimitedSend(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	// second slice waits about 100s
+	p.A.SetSendRateLimit(100, 100)
+
+	done := make(chan error)
+	go func() {
+		p.A.jrpcPushMessageToOutsideCB(testSliceResponse(p.A, 1, 10))
+		done <- p.A.jrpcPushMessageToOutsideCB(testSliceResponse(p.A, 2, 10000))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	p.A.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Fatal("expected ErrClosed, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send still sleeping in limiter after Close")
+	}
+}
+
+// slice waiting for tokens must not hold back control messages
+func TestSendLimiterDoesNotBlockControl(t *testing.T) {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(nil)
+	defer p.Close()
+
+	p.A.SetSendRateLimit(100, 100)
+
+	go func() {
+		p.A.jrpcPushMessageToOutsideCB(testSliceResponse(p.A, 1, 10))
+		p.A.jrpcPushMessageToOutsideCB(testSliceResponse(p.A, 2, 10000))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, m := range []string{
+		`{"jsonrpc":"2.0","id":"p1","method":"pi","params":{}}`,
+		`{"jsonrpc":"2.0","id":"t1","method":"tc","params":{"id":"x","d":"00"}}`,
+		`{"jsonrpc":"2.0","id":"g1","method":"ga","params":{}}`,
+	} {
+		done := make(chan error, 1)
+		go func() {
+			done <- p.A.jrpcPushMessageToOutsideCB([]byte(m))
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("control message held back by rate limited slice:", m)
+		}
+	}
+}
+
+func TestTokenBucketWaitCancelable(t *testing.T) {
+	b := NewJSONRPC2DataStreamMultiplexerTokenBucket(100, 100)
+
+	if !b.WaitCancelable(100, nil) {
+		t.Fatal("burst must be available immediately")
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+
+	started := time.Now()
+	if b.WaitCancelable(1000, cancel) {
+		t.Fatal("WaitCancelable returned true after cancel")
+	}
+	if time.Since(started) > time.Second {
+		t.Fatal("WaitCancelable didn't return on cancel")
+	}
+}
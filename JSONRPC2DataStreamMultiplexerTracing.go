@@ -0,0 +1,145 @@
+package gojsonrpc2datastreammultiplexer
+
+// tracing.
+//
+// if JSONRPC2DataStreamMultiplexer.Tracer is set, multiplexer creates spans:
+//   - "jrpcmux.send" - for each ChannelData* call, child of span in
+//     JSONRPC2DataStreamMultiplexerChannelDataOptions.Context (if any);
+//   - "jrpcmux.receive" - for each incomming transfer, child of sender's
+//     "jrpcmux.send" span;
+//   - "jrpcmux.gbi", "jrpcmux.gbs" - for each request receiver makes to pull
+//     buffer, children of "jrpcmux.receive".
+//
+// trace context is passed to receiver in "t" field of "n" request, using
+// Tracer.Inject() and Tracer.Extract(). "n" request must fit into
+// JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE, so too large trace context is
+// dropped (with warning) and transfer goes on untraced on receiver's side.
+//
+// interfaces are minimal, so core doesn't depend on any tracing library.
+// OpenTelemetry can be plugged in with thin adapter (trace.Tracer.Start(),
+// propagation.TextMapPropagator with propagation.MapCarrier).
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// room reserved in "n" request for JSON-RPC envelope ("jsonrpc", "method",
+// request id), when checking if trace context fits into it
+const JSONRPC2_MULTIPLEXER_REQUEST_ENVELOPE_SIZE = 128
+
+type JSONRPC2DataStreamMultiplexerSpan interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+type JSONRPC2DataStreamMultiplexerTracer interface {
+	// starts span, which is child of span in ctx (if any). returned ctx
+	// contains new span
+	Start(ctx context.Context, name string) (context.Context, JSONRPC2DataStreamMultiplexerSpan)
+	// puts trace context from ctx into carrier
+	Inject(ctx context.Context, carrier map[string]string)
+	// returns ctx with remote trace context from carrier
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, any) {}
+func (nopSpan) RecordError(error)        {}
+func (nopSpan) End()                     {}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, JSONRPC2DataStreamMultiplexerSpan) {
+	return ctx, nopSpan{}
+}
+func (nopTracer) Inject(context.Context, map[string]string) {}
+func (nopTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return ctx
+}
+
+func (self *JSONRPC2DataStreamMultiplexer) getTracer() JSONRPC2DataStreamMultiplexerTracer {
+	if self.Tracer == nil {
+		return nopTracer{}
+	}
+	return self.Tracer
+}
+
+// puts trace context from ctx into "n" request, if it fits
+func (self *JSONRPC2DataStreamMultiplexer) injectTrace(
+	ctx context.Context,
+	msg *JSONRPC2DataStreamMultiplexer_proto_NewBufferAvailable_Req,
+) {
+	carrier := make(map[string]string)
+	self.getTracer().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return
+	}
+
+	msg.Trace = carrier
+
+	b, err := json.Marshal(msg)
+	if err == nil &&
+		len(b)+JSONRPC2_MULTIPLEXER_REQUEST_ENVELOPE_SIZE < JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE {
+		return
+	}
+
+	msg.Trace = nil
+
+	if self.debug {
+		self.DebugPrintln("trace context dropped: \"n\" request is too big.", len(b), err)
+	}
+	self.logger.Warn(
+		"trace context dropped: doesn't fit into \"n\" request",
+		"buffer_id", msg.BufferId,
+		"size", len(b),
+		"err", err,
+	)
+}
+
+// records error (if any) and ends span
+func endSpan(
+	span JSONRPC2DataStreamMultiplexerSpan,
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	switch {
+	case proto_err != nil:
+		span.RecordError(proto_err)
+	case err != nil:
+		span.RecordError(err)
+	case timedout:
+		span.RecordError(ErrTransferTimeout)
+	case closed:
+		span.RecordError(ErrClosed)
+	}
+	span.End()
+}
+
+func traceCarrierFrom_msg_par(msg_par map[string]any) (map[string]string, error) {
+	t_any, ok := msg_par["t"]
+	if !ok {
+		return nil, nil
+	}
+
+	t_map, ok := t_any.(map[string]any)
+	if !ok {
+		return nil, errors.New("can't use 't' as json object")
+	}
+
+	ret := make(map[string]string, len(t_map))
+	for k, v := range t_map {
+		v_str, ok := v.(string)
+		if !ok {
+			return nil, errors.New("'t' values must be strings")
+		}
+		ret[k] = v_str
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,84 @@
+package gojsonrpc2datastreammultiplexer
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// injects 'value' as trace context and remembers extracted ones
+type testCarrierTracer struct {
+	nopTracer
+	value string
+
+	mutex     sync.Mutex
+	extracted []map[string]string
+}
+
+func (self *testCarrierTracer) Inject(ctx context.Context, carrier map[string]string) {
+	carrier["traceparent"] = self.value
+}
+
+func (self *testCarrierTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.extracted = append(self.extracted, carrier)
+	return ctx
+}
+
+func testTraceCarrier(t *testing.T, value string) map[string]string {
+	p := NewJSONRPC2DataStreamMultiplexerPipePair(
+		&JSONRPC2DataStreamMultiplexerPipeOptions{
+			MaxMessageSize: JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE - 1,
+		},
+	)
+	defer p.Close()
+
+	tracer := &testCarrierTracer{value: value}
+	p.A.Tracer = tracer
+	p.B.Tracer = tracer
+
+	received := make(chan struct{}, 1)
+	p.B.OnIncommingDataTransferComplete = func(io.WriteSeeker) {
+		received <- struct{}{}
+	}
+
+	timedout, closed, _, proto_err, err := p.A.ChannelData(testData(100, 0))
+	if timedout || closed || proto_err != nil || err != nil {
+		t.Fatal("transfer failed:", timedout, closed, proto_err, err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("data not received")
+	}
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	if len(tracer.extracted) != 1 {
+		t.Fatal("Extract() called", len(tracer.extracted), "times")
+	}
+	return tracer.extracted[0]
+}
+
+func TestTraceCarrierPassed(t *testing.T) {
+	value := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	carrier := testTraceCarrier(t, value)
+	if carrier["traceparent"] != value {
+		t.Fatal("trace context not passed:", carrier)
+	}
+}
+
+func TestTooLargeTraceCarrierDropped(t *testing.T) {
+	carrier := testTraceCarrier(t, strings.Repeat("x", JSONRPC2_MULTIPLEXER_MAX_MESSAGE_SIZE))
+	if len(carrier) != 0 {
+		t.Fatal("too large trace context passed")
+	}
+}
@@ -0,0 +1,220 @@
+package gojsonrpc2datastreammultiplexer
+
+// transfer outcome.
+//
+// receiver acknowledges "n" request immediately and pulls buffer
+// asynchronously. when pull is finished, receiver sends to sender either
+// "tc" (transfer complete) request with sha256 digest of received data, or
+// "tf" (transfer failed) request with reason. sender compares digest with
+// digest of own buffer, and only then ChannelData* call returns.
+//
+// "n" isn't retried, so if it's response is lost or late, sender stops
+// waiting for it as soon as peer starts pulling buffer.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/AnimusPEXUS/gojsonrpc2"
+)
+
+const (
+	JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE = "tc"
+	JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED   = "tf"
+)
+
+var (
+	ErrTransferFailed = errors.New("peer failed to receive buffer")
+	ErrDigestMismatch = errors.New("digest of data received by peer doesn't match")
+)
+
+// tells peer result of pulling buffer 'buffid'
+func (self *JSONRPC2DataStreamMultiplexer) reportTransferOutcome(
+	buffid string,
+	digest []byte,
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	if closed {
+		return
+	}
+
+	m := new(gojsonrpc2.Message)
+
+	if !timedout && proto_err == nil && err == nil {
+		m.Method = JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE
+		p := new(JSONRPC2DataStreamMultiplexer_proto_TransferComplete_Req)
+		p.BufferId = buffid
+		p.Digest = hex.EncodeToString(digest)
+
+		self.logger.Info("incomming transfer complete", "buffer_id", buffid, "digest", p.Digest)
+		m.Params = p
+	} else {
+		reason := "timeout"
+		if proto_err != nil {
+			reason = proto_err.Error()
+		} else if err != nil {
+			reason = err.Error()
+		}
+
+		self.logger.Warn("incomming transfer failed", "buffer_id", buffid, "reason", reason)
+
+		m.Method = JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED
+		p := new(JSONRPC2DataStreamMultiplexer_proto_TransferFailed_Req)
+		p.BufferId = buffid
+		p.Reason = reason
+		m.Params = p
+	}
+
+	// "tc"/"tf" are idempotent, so can be retried
+	_, _, _, proto_err2, err2 :=
+		self.requestSendingRespWaitingRoutine(m, nil, 0, 0, true, nil, nil)
+	if proto_err2 != nil || err2 != nil {
+		self.logger.Warn(
+			"can't report transfer outcome",
+			"buffer_id", buffid,
+			"method", m.Method,
+			"proto_err", proto_err2,
+			"err", err2,
+		)
+	}
+}
+
+// waits for "tc"/"tf" from peer and verifies digest
+func (self *JSONRPC2DataStreamMultiplexer) waitTransferOutcome(
+	wrapper *JSONRPC2DataStreamMultiplexerBufferWrapper,
+) (
+	timedout bool,
+	closed bool,
+	resp_msg *gojsonrpc2.Message,
+	proto_err error,
+	err error,
+) {
+
+	select {
+	case resp_msg = <-wrapper.outcome:
+	case <-wrapper.aborted:
+		err = wrapper.abortErr()
+		return errors.Is(err, ErrTransferTimeout), false, nil, nil, err
+	case <-self.getPeerLostChan():
+		return false, false, nil, nil, ErrPeerLost
+	case <-self.closed_chan:
+		return false, true, nil, nil, ErrClosed
+	}
+
+	msg_par, ok := (resp_msg.Params).(map[string]any)
+	if !ok {
+		return false,
+			false,
+			nil,
+			errors.New("can't convert msg.Params to map[string]string"),
+			errors.New("protocol error")
+	}
+
+	if resp_msg.Method == JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED {
+		reason, _ := msg_par["r"].(string)
+		self.logger.Warn("outgoing transfer failed", "buffer_id", wrapper.BufferId, "reason", reason)
+		return false, false, nil, nil, fmt.Errorf("%w: %s", ErrTransferFailed, reason)
+	}
+
+	d_str, ok := msg_par["d"].(string)
+	if !ok {
+		return false,
+			false,
+			nil,
+			errors.New("can't get 'd' string value from json object"),
+			errors.New("protocol error")
+	}
+
+	peer_digest, err := hex.DecodeString(d_str)
+	if err != nil {
+		return false, false, nil, err, errors.New("protocol error")
+	}
+
+	digest, err := wrapper.BufferDigest()
+	if err != nil {
+		return false, false, nil, nil, err
+	}
+
+	if !bytes.Equal(digest, peer_digest) {
+		self.logger.Warn("outgoing transfer digest mismatch", "buffer_id", wrapper.BufferId)
+		return false, false, nil, nil, ErrDigestMismatch
+	}
+
+	self.logger.Info(
+		"outgoing transfer complete",
+		"buffer_id", wrapper.BufferId,
+		"request_id", wrapper.RequestId,
+		"size", wrapper.size,
+		"peer", self.GetPeerIdentity(),
+	)
+
+	return false, false, resp_msg, nil, nil
+}
+
+// handles both "tc" and "tf"
+func (self *JSONRPC2DataStreamMultiplexer) jrpcOnRequestCB_TRANSFER_OUTCOME(msg *gojsonrpc2.Message) (
+	timedout bool,
+	closed bool,
+	proto_err error,
+	err error,
+) {
+	msg_par, ok := (msg.Params).(map[string]any)
+	if !ok {
+		return false,
+			false,
+			errors.New("can't convert msg.Params to map[string]string"),
+			errors.New("protocol error")
+	}
+
+	buffid_str, proto_err, err := getBuffIdFrom_msg_par(msg_par)
+	if proto_err != nil || err != nil {
+		return false, false, proto_err, err
+	}
+
+	if self.debug {
+		self.DebugPrintln("jrpcOnRequestCB_TRANSFER_OUTCOME:", msg.Method, buffid_str)
+	}
+
+	wrapper, ok := self.getBuffByIdLocal(buffid_str)
+	if !ok {
+		return false,
+			false,
+			errors.New("outcome for unknown buffer"),
+			errors.New("protocol error")
+	}
+
+	wrapper.accept()
+
+	first := func() bool {
+		wrapper.Mutex.Lock()
+		defer wrapper.Mutex.Unlock()
+
+		ret := !wrapper.got_outcome
+		wrapper.got_outcome = true
+		return ret
+	}()
+
+	// first outcome wins: repeated ones (retries) are ignored, except "tf"
+	// after "tc" on buffer waiting for reply (see JSONRPC2DataStreamMultiplexerReply.go)
+	switch {
+	case first:
+		wrapper.outcome <- msg
+	case msg.Method == JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED && wrapper.reply_failed != nil:
+		select {
+		case wrapper.reply_failed <- msg:
+		default:
+		}
+	}
+
+	err = self.sendResult(msg, map[string]any{})
+	if err != nil {
+		return false, false, nil, err
+	}
+
+	return false, false, nil, nil
+}
@@ -6,6 +6,21 @@ type JSONRPC2DataStreamMultiplexer_proto_NewBufferMsg struct {
 	BufferId string `json:"id"`
 }
 
+type JSONRPC2DataStreamMultiplexer_proto_NewBufferAvailable_Req struct {
+	JSONRPC2DataStreamMultiplexer_proto_NewBufferMsg
+	Priority  int   `json:"p,omitempty"`
+	RateLimit int64 `json:"r,omitempty"` // bytes per second
+	// sender waits for reply. see JSONRPC2DataStreamMultiplexerReply.go
+	WantsReply bool `json:"w,omitempty"`
+	// this buffer is reply on buffer with this id
+	ReplyTo string `json:"rt,omitempty"`
+	// milliseconds: sender forgets buffer, not accessed for this long.
+	// see JSONRPC2DataStreamMultiplexerBufferExpiry.go
+	IdleExpiry int64 `json:"x,omitempty"`
+	// trace context. see JSONRPC2DataStreamMultiplexerTracing.go
+	Trace map[string]string `json:"t,omitempty"`
+}
+
 type JSONRPC2DataStreamMultiplexer_proto_BufferInfo_Req struct {
 	JSONRPC2DataStreamMultiplexer_proto_NewBufferMsg
 }
@@ -23,3 +38,26 @@ type JSONRPC2DataStreamMultiplexer_proto_BufferSlice_Req struct {
 type JSONRPC2DataStreamMultiplexer_proto_BufferSlice_Res struct {
 	Data string `json:"data"` // base64 encoded
 }
+
+type JSONRPC2DataStreamMultiplexer_proto_AuthChallenge_Res struct {
+	Challenge string `json:"c"` // base64 encoded
+}
+
+type JSONRPC2DataStreamMultiplexer_proto_AuthResponse_Req struct {
+	Identity string `json:"i"`
+	Response string `json:"r"` // base64 encoded
+}
+
+type JSONRPC2DataStreamMultiplexer_proto_AuthResponse_Res struct {
+	Ok bool `json:"ok"`
+}
+
+type JSONRPC2DataStreamMultiplexer_proto_TransferComplete_Req struct {
+	JSONRPC2DataStreamMultiplexer_proto_NewBufferMsg
+	Digest string `json:"d"` // hex encoded sha256 of received data
+}
+
+type JSONRPC2DataStreamMultiplexer_proto_TransferFailed_Req struct {
+	JSONRPC2DataStreamMultiplexer_proto_NewBufferMsg
+	Reason string `json:"r"`
+}
@@ -0,0 +1,279 @@
+// jrpcmux sends and receives files over JSONRPC2DataStreamMultiplexer.
+//
+// multiplexer messages are carried in length-prefixed frames (see
+// JSONRPC2DataStreamMultiplexerFrames.go) over stdin/stdout, unix socket or
+// TCP connection. any side may listen or connect:
+//
+//	jrpcmux receive -listen tcp:127.0.0.1:9000 -dir incomming
+//	jrpcmux send -connect tcp:127.0.0.1:9000 file1 dir1
+//
+// without -listen and -connect stdin/stdout is used, so peers can be
+// connected with pipes, ssh, socat, etc.
+//
+// each file is sent as one buffer: 4 byte big-endian header length, JSON
+// header ({"name":"dir1/a.txt","size":123,"mode":420}) and file contents.
+// directories are sent recursively, as their regular files. receiver writes
+// file into -dir and replies with JSON ({"ok":true} or {"error":"..."}), so
+// sender knows file is stored. receiver refuses buffers larger than
+// -max-size (1 GiB by default) before creating anything on disk.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gojsonrpc2datastreammultiplexer "github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer"
+)
+
+const progress_interval = 500 * time.Millisecond
+
+type fileHeader struct {
+	// slash separated, relative
+	Name string      `json:"name"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+}
+
+type fileReply struct {
+	Ok    bool   `json:"ok,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error                { return os.Stdout.Close() }
+
+// "tcp:host:port" or "unix:/path"
+func parseAddress(addr string) (network string, address string, err error) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok || address == "" {
+		return "", "", fmt.Errorf("invalid address %q: must be tcp:host:port or unix:/path", addr)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return "", "", fmt.Errorf("invalid address %q: unsupported network %q", addr, network)
+	}
+	return network, address, nil
+}
+
+// listen != "" - wait for one connection, connect != "" - connect,
+// both empty - stdin/stdout
+func openConnection(listen string, connect string) (io.ReadWriteCloser, error) {
+	switch {
+	case listen != "" && connect != "":
+		return nil, errors.New("-listen and -connect can't be used together")
+
+	case listen != "":
+		network, address, err := parseAddress(listen)
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		fmt.Fprintln(os.Stderr, "waiting for connection on", l.Addr())
+		return l.Accept()
+
+	case connect != "":
+		network, address, err := parseAddress(connect)
+		if err != nil {
+			return nil, err
+		}
+		return net.Dial(network, address)
+
+	default:
+		return stdio{}, nil
+	}
+}
+
+// multiplexer, running over conn
+type link struct {
+	multiplexer *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer
+	conn        io.ReadWriteCloser
+
+	write_mutex sync.Mutex
+
+	// closed, when conn is closed or broken
+	done     chan struct{}
+	read_err error
+}
+
+func newLink(conn io.ReadWriteCloser, name string, verbose bool) *link {
+	self := new(link)
+	self.conn = conn
+	self.done = make(chan struct{})
+
+	self.multiplexer = gojsonrpc2datastreammultiplexer.NewJSONRPC2DataStreamMultiplexer()
+	self.multiplexer.SetDebugName(name)
+
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelInfo
+	}
+	self.multiplexer.SetLogger(
+		slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	)
+
+	self.multiplexer.PushMessageToOutsideCB = func(data []byte) error {
+		self.write_mutex.Lock()
+		defer self.write_mutex.Unlock()
+
+		return gojsonrpc2datastreammultiplexer.WriteJSONRPC2DataStreamMultiplexerFrame(self.conn, data)
+	}
+
+	return self
+}
+
+// reads frames until conn is closed
+func (self *link) run() {
+	defer close(self.done)
+	// peer is gone: wake everything waiting for it
+	defer self.multiplexer.Close()
+
+	for {
+		data, err := gojsonrpc2datastreammultiplexer.ReadJSONRPC2DataStreamMultiplexerFrame(self.conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				self.read_err = err
+			}
+			return
+		}
+
+		proto_err, err := self.multiplexer.PushMessageFromOutside(data)
+		if proto_err != nil || err != nil {
+			fmt.Fprintln(os.Stderr, "bad message from peer:", proto_err, err)
+		}
+	}
+}
+
+func (self *link) close() {
+	self.multiplexer.Close()
+	self.conn.Close()
+}
+
+// reads whole WriteSeeker (which must also be ReadSeeker)
+func readAll(ws io.WriteSeeker) ([]byte, error) {
+	rs, ok := ws.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("not readable")
+	}
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, size)
+	_, err = io.ReadFull(rs, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// buffer ids come from peer and may be of any length
+func shortId(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// prints progress of transfers to stderr until stop is closed
+func showProgress(
+	multiplexer *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer,
+	label func() string,
+	stop <-chan struct{},
+) {
+	ticker := time.NewTicker(progress_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		transfers := multiplexer.ListTransfers()
+
+		var parts []string
+		for _, t := range transfers.Outgoing {
+			if t.Size > 0 {
+				parts = append(
+					parts,
+					fmt.Sprintf("%s %.1f%% (%d/%d)", label(), float64(t.BytesServed)*100/float64(t.Size), t.BytesServed, t.Size),
+				)
+			}
+		}
+		for _, t := range transfers.Incomming {
+			if t.Size > 0 {
+				parts = append(
+					parts,
+					fmt.Sprintf("%q %.1f%% (%d/%d)", shortId(t.BufferId), float64(t.BytesReceived)*100/float64(t.Size), t.BytesReceived, t.Size),
+				)
+			}
+		}
+
+		if len(parts) != 0 {
+			fmt.Fprintln(os.Stderr, strings.Join(parts, ", "))
+		}
+	}
+}
+
+func usage() {
+	fmt.Fprintf(
+		os.Stderr,
+		"usage:\n"+
+			"  %[1]s send [-listen addr | -connect addr] [-q] [-v] path...\n"+
+			"  %[1]s receive [-listen addr | -connect addr] [-dir dir] [-max-size bytes] [-q] [-v]\n"+
+			"\n"+
+			"addr is tcp:host:port or unix:/path. without -listen and -connect\n"+
+			"stdin/stdout is used.\n",
+		os.Args[0],
+	)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "send":
+		err = send(os.Args[2:])
+	case "receive":
+		err = receive(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
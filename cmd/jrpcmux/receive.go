@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const max_header_size = 64 * 1024
+
+// default of -max-size
+const default_max_size = 1024 * 1024 * 1024
+
+type receiver struct {
+	dir   string
+	quiet bool
+	// largest buffer accepted from sender. 0 - no limit
+	max_size int64
+
+	// buffers being received. removed on exit
+	parts_mutex sync.Mutex
+	parts       map[*os.File]struct{}
+}
+
+// OnRequestToProvideWriteSeekerCB: buffers are received into temporary files
+func (self *receiver) providePart(
+	size int64,
+	provide_data_destination func(io.WriteSeeker) error,
+) error {
+	// size is announced by sender: check it before anything is allocated
+	if size < 0 {
+		return fmt.Errorf("invalid buffer size %d", size)
+	}
+	if self.max_size > 0 && size > self.max_size {
+		return fmt.Errorf("buffer size %d exceeds -max-size %d", size, self.max_size)
+	}
+
+	f, err := os.CreateTemp(self.dir, ".jrpcmux-*.part")
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(size)
+	if err == nil {
+		err = provide_data_destination(f)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	self.parts_mutex.Lock()
+	self.parts[f] = struct{}{}
+	self.parts_mutex.Unlock()
+
+	return nil
+}
+
+func (self *receiver) removePart(f *os.File) {
+	self.parts_mutex.Lock()
+	delete(self.parts, f)
+	self.parts_mutex.Unlock()
+
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (self *receiver) removeParts() {
+	self.parts_mutex.Lock()
+	parts := self.parts
+	self.parts = make(map[*os.File]struct{})
+	self.parts_mutex.Unlock()
+
+	for f := range parts {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// writes file from received buffer into self.dir
+func (self *receiver) storeFile(part *os.File) (*fileHeader, error) {
+	total, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = part.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var header_size_b [4]byte
+	_, err = io.ReadFull(part, header_size_b[:])
+	if err != nil {
+		return nil, errors.New("buffer is too short")
+	}
+
+	header_size := int64(binary.BigEndian.Uint32(header_size_b[:]))
+	if header_size > max_header_size || 4+header_size > total {
+		return nil, errors.New("invalid header size")
+	}
+
+	header_json := make([]byte, header_size)
+	_, err = io.ReadFull(part, header_json)
+	if err != nil {
+		return nil, err
+	}
+
+	header := new(fileHeader)
+	dec := json.NewDecoder(bytes.NewReader(header_json))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	if header.Size != total-4-header_size {
+		return nil, errors.New("header size doesn't match buffer size")
+	}
+
+	name := filepath.FromSlash(header.Name)
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid file name %q", header.Name)
+	}
+
+	target := filepath.Join(self.dir, name)
+
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := header.Mode.Perm()
+	if mode == 0 {
+		mode = 0o644
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.CopyN(f, part, header.Size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+func (self *receiver) received(ws io.WriteSeeker) error {
+	part, ok := ws.(*os.File)
+	if !ok {
+		return errors.New("unexpected buffer type")
+	}
+	defer self.removePart(part)
+
+	header, err := self.storeFile(part)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't store received file:", err)
+		return err
+	}
+
+	if !self.quiet {
+		fmt.Fprintf(os.Stderr, "received %s (%d bytes)\n", header.Name, header.Size)
+	}
+
+	return nil
+}
+
+func receive(args []string) error {
+	flags := flag.NewFlagSet("receive", flag.ExitOnError)
+	listen := flags.String("listen", "", "wait for sender on this address")
+	connect := flags.String("connect", "", "connect to sender on this address")
+	dir := flags.String("dir", ".", "directory to write received files to")
+	max_size := flags.Int64("max-size", default_max_size, "largest buffer (file with header) accepted from sender, in bytes. 0 - no limit")
+	quiet := flags.Bool("q", false, "don't show progress")
+	verbose := flags.Bool("v", false, "log multiplexer events")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	err := os.MkdirAll(*dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	if *max_size < 0 {
+		return errors.New("-max-size can't be negative")
+	}
+
+	r := &receiver{
+		dir:      *dir,
+		quiet:    *quiet,
+		max_size: *max_size,
+		parts:    make(map[*os.File]struct{}),
+	}
+	defer r.removeParts()
+
+	conn, err := openConnection(*listen, *connect)
+	if err != nil {
+		return err
+	}
+
+	l := newLink(conn, "jrpcmux receive", *verbose)
+	defer l.close()
+
+	l.multiplexer.OnRequestToProvideWriteSeekerCB = r.providePart
+
+	// sender waits for reply (see send.go)
+	l.multiplexer.OnIncommingDataTransferReplyCB = func(ws io.WriteSeeker) (io.ReadSeeker, error) {
+		reply := fileReply{Ok: true}
+		err := r.received(ws)
+		if err != nil {
+			reply = fileReply{Error: err.Error()}
+		}
+
+		b, err := json.Marshal(reply)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(b), nil
+	}
+
+	// sender doesn't wait for reply
+	l.multiplexer.OnIncommingDataTransferComplete = func(ws io.WriteSeeker) {
+		r.received(ws)
+	}
+
+	if !*quiet {
+		stop := make(chan struct{})
+		defer close(stop)
+		go showProgress(l.multiplexer, func() string { return "" }, stop)
+	}
+
+	l.run()
+
+	if l.read_err != nil {
+		return l.read_err
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const shutdown_timeout = 10 * time.Second
+
+// header followed by file contents
+type prefixedFile struct {
+	header []byte
+	file   io.ReaderAt
+	size   int64
+	pos    int64
+}
+
+func newPrefixedFile(header []byte, file io.ReaderAt, file_size int64) *prefixedFile {
+	self := new(prefixedFile)
+	self.header = header
+	self.file = file
+	self.size = int64(len(header)) + file_size
+	return self
+}
+
+func (self *prefixedFile) Read(p []byte) (int, error) {
+	if self.pos >= self.size {
+		return 0, io.EOF
+	}
+
+	if self.pos < int64(len(self.header)) {
+		n := copy(p, self.header[self.pos:])
+		self.pos += int64(n)
+		return n, nil
+	}
+
+	if rest := self.size - self.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	n, err := self.file.ReadAt(p, self.pos-int64(len(self.header)))
+	self.pos += int64(n)
+	if errors.Is(err, io.EOF) && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (self *prefixedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.pos
+	case io.SeekEnd:
+		offset += self.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	self.pos = offset
+	return offset, nil
+}
+
+type sendItem struct {
+	path string
+	// name for receiver
+	name string
+}
+
+// regular files of paths. directories are walked, their names are kept
+func collectFiles(paths []string) ([]sendItem, error) {
+	var ret []sendItem
+
+	for _, p := range paths {
+		base := filepath.Dir(filepath.Clean(p))
+
+		err := filepath.WalkDir(
+			p,
+			func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				if !d.Type().IsRegular() {
+					fmt.Fprintln(os.Stderr, "skipping not regular file:", path)
+					return nil
+				}
+
+				rel, err := filepath.Rel(base, path)
+				if err != nil {
+					return err
+				}
+
+				ret = append(ret, sendItem{path: path, name: filepath.ToSlash(rel)})
+				return nil
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (self *link) sendFile(item sendItem) (int64, error) {
+	f, err := os.Open(item.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	header_json, err := json.Marshal(
+		fileHeader{
+			Name: item.name,
+			Size: stat.Size(),
+			Mode: stat.Mode().Perm(),
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 4+len(header_json))
+	binary.BigEndian.PutUint32(header, uint32(len(header_json)))
+	copy(header[4:], header_json)
+
+	timedout, closed, reply_ws, proto_err, err :=
+		self.multiplexer.ChannelDataReaderWithReply(
+			newPrefixedFile(header, f, stat.Size()),
+			nil,
+		)
+	switch {
+	case proto_err != nil:
+		return 0, fmt.Errorf("protocol error: %w", proto_err)
+	case err != nil:
+		return 0, err
+	case timedout:
+		return 0, errors.New("timeout")
+	case closed:
+		return 0, errors.New("connection closed")
+	}
+
+	reply_bytes, err := readAll(reply_ws)
+	if err != nil {
+		return 0, err
+	}
+
+	var reply fileReply
+	err = json.Unmarshal(reply_bytes, &reply)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reply from receiver: %w", err)
+	}
+	if !reply.Ok {
+		return 0, fmt.Errorf("receiver: %s", reply.Error)
+	}
+
+	return stat.Size(), nil
+}
+
+func send(args []string) error {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	listen := flags.String("listen", "", "wait for receiver on this address")
+	connect := flags.String("connect", "", "connect to receiver on this address")
+	quiet := flags.Bool("q", false, "don't show progress")
+	verbose := flags.Bool("v", false, "log multiplexer events")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("nothing to send")
+	}
+
+	items, err := collectFiles(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	conn, err := openConnection(*listen, *connect)
+	if err != nil {
+		return err
+	}
+
+	l := newLink(conn, "jrpcmux send", *verbose)
+	defer l.close()
+
+	go l.run()
+
+	var (
+		current_mutex sync.Mutex
+		current       string
+	)
+
+	if !*quiet {
+		stop := make(chan struct{})
+		defer close(stop)
+		go showProgress(
+			l.multiplexer,
+			func() string {
+				current_mutex.Lock()
+				defer current_mutex.Unlock()
+				return current
+			},
+			stop,
+		)
+	}
+
+	failed := 0
+	for _, item := range items {
+		current_mutex.Lock()
+		current = item.name
+		current_mutex.Unlock()
+
+		started := time.Now()
+		size, err := l.sendFile(item)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %v\n", item.name, err)
+
+			select {
+			case <-l.done:
+				return errors.New("connection closed")
+			default:
+			}
+			continue
+		}
+
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "sent %s (%d bytes, %v)\n", item.name, size, time.Since(started).Round(time.Millisecond))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+	l.multiplexer.Shutdown(ctx)
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d files not sent", failed, len(items))
+	}
+
+	return nil
+}
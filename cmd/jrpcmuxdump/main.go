@@ -0,0 +1,586 @@
+// jrpcmuxdump prints captured multiplexer messages as human readable
+// timeline, followed by per-transfer summaries.
+//
+// input is either recording, made with JSONRPC2DataStreamMultiplexerRecorder
+// (JSONL), or stream of length-prefixed frames (see
+// JSONRPC2DataStreamMultiplexerFrames.go), like one captured from
+// jrpcmux connection. format is detected automatically.
+//
+// frames have neither time nor direction: use -dir to tell which side
+// produced them.
+//
+// usage:
+//
+//	jrpcmuxdump [-format auto|jsonl|frames] [-dir in|out] [-gap 1s] [-q] [file|-]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	gojsonrpc2datastreammultiplexer "github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer"
+)
+
+type message = map[string]any
+
+type event struct {
+	index int
+	// zero - unknown
+	time time.Time
+	// "in", "out" or "?"
+	dir  string
+	data []byte
+}
+
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+type transfer struct {
+	buffid string
+	// side, which announced buffer
+	dir         string
+	first       time.Time
+	last        time.Time
+	size        int64
+	priority    string
+	wants_reply bool
+	reply_to    string
+
+	slices_requested int
+	slices_received  int
+	bytes_received   int64
+	retries          int
+	errors           int
+
+	requested map[byteRange]bool
+	received  []byteRange
+
+	outcome string
+}
+
+type request struct {
+	method string
+	buffid string
+	rng    byteRange
+}
+
+type Dumper struct {
+	out io.Writer
+
+	gap   time.Duration
+	quiet bool
+
+	start time.Time
+	prev  time.Time
+
+	// request direction + "/" + id -> request
+	pending map[string]*request
+
+	transfers       map[string]*transfer
+	transfers_order []string
+
+	messages  map[string]int
+	errors    int
+	invalid   int
+	responses int
+}
+
+func NewDumper(out io.Writer) *Dumper {
+	self := new(Dumper)
+	self.out = out
+	self.pending = make(map[string]*request)
+	self.transfers = make(map[string]*transfer)
+	self.messages = make(map[string]int)
+	return self
+}
+
+func opposite(dir string) string {
+	switch dir {
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_IN:
+		return gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_OUT
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_OUT:
+		return gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_IN
+	}
+	return dir
+}
+
+func idString(id any) string {
+	if id == nil {
+		return "-"
+	}
+	b, _ := json.Marshal(id)
+	return string(b)
+}
+
+func str(m map[string]any, key string) string {
+	ret, _ := m[key].(string)
+	return ret
+}
+
+func number(m map[string]any, key string) (int64, bool) {
+	n, ok := m[key].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	ret, err := n.Int64()
+	return ret, err == nil
+}
+
+func priorityName(m map[string]any) string {
+	p, _ := number(m, "p")
+	return gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerPriority(p).String()
+}
+
+func short(s string, max int) string {
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
+
+func (self *Dumper) transfer(buffid string, t time.Time) *transfer {
+	ret, ok := self.transfers[buffid]
+	if !ok {
+		ret = &transfer{
+			buffid:    buffid,
+			size:      -1,
+			first:     t,
+			requested: make(map[byteRange]bool),
+		}
+		self.transfers[buffid] = ret
+		self.transfers_order = append(self.transfers_order, buffid)
+	}
+	if !t.IsZero() {
+		ret.last = t
+	}
+	return ret
+}
+
+func (self *Dumper) printf(e *event, id string, kind string, format string, args ...any) {
+	if self.quiet {
+		return
+	}
+
+	stamp := "       -"
+	if !e.time.IsZero() {
+		stamp = fmt.Sprintf("%8.3f", e.time.Sub(self.start).Seconds())
+	}
+
+	fmt.Fprintf(
+		self.out,
+		"%s %5d %-3s %-6s %-4s %s\n",
+		stamp, e.index, e.dir, id, kind,
+		fmt.Sprintf(format, args...),
+	)
+}
+
+func (self *Dumper) Event(e *event) {
+	if !e.time.IsZero() {
+		if self.start.IsZero() {
+			self.start = e.time
+			self.prev = e.time
+		}
+		if self.gap > 0 && !self.quiet {
+			if d := e.time.Sub(self.prev); d >= self.gap {
+				fmt.Fprintf(self.out, "         ----- %v gap -----\n", d.Round(time.Millisecond))
+			}
+		}
+		self.prev = e.time
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(e.data))
+	dec.UseNumber()
+
+	var m message
+	err := dec.Decode(&m)
+	if err != nil || m == nil {
+		self.invalid++
+		self.printf(e, "-", "!!!", "invalid message (%d bytes): %q", len(e.data), short(string(e.data), 80))
+		return
+	}
+
+	id := idString(m["id"])
+
+	method, is_request := m["method"].(string)
+	if is_request {
+		self.messages[method]++
+		self.request(e, id, method, m)
+		return
+	}
+
+	self.responses++
+	self.response(e, id, m)
+}
+
+func (self *Dumper) request(e *event, id string, method string, m message) {
+	p, _ := m["params"].(map[string]any)
+	if p == nil {
+		p = map[string]any{}
+	}
+	buffid := str(p, "id")
+
+	req := &request{method: method, buffid: buffid}
+	if id != "-" {
+		self.pending[e.dir+"/"+id] = req
+	}
+
+	switch method {
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE:
+		t := self.transfer(buffid, e.time)
+		t.dir = e.dir
+		t.priority = priorityName(p)
+		t.wants_reply, _ = p["w"].(bool)
+		t.reply_to = str(p, "rt")
+
+		desc := fmt.Sprintf("announce buffer %s priority=%s", buffid, t.priority)
+		if r, ok := number(p, "r"); ok {
+			desc += fmt.Sprintf(" rate=%d B/s", r)
+		}
+		if t.wants_reply {
+			desc += " wants-reply"
+		}
+		if t.reply_to != "" {
+			desc += " reply-to=" + t.reply_to
+		}
+		if _, ok := p["t"]; ok {
+			desc += " traced"
+		}
+		self.printf(e, id, method, "%s", desc)
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO:
+		self.transfer(buffid, e.time)
+		self.printf(e, id, method, "info? buffer %s", buffid)
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE:
+		t := self.transfer(buffid, e.time)
+		start, _ := number(p, "start")
+		end, _ := number(p, "end")
+		req.rng = byteRange{start, end}
+
+		t.slices_requested++
+		note := ""
+		if t.requested[req.rng] {
+			t.retries++
+			note = " (retry)"
+		}
+		t.requested[req.rng] = true
+
+		self.printf(
+			e, id, method,
+			"slice? buffer %s [%d, %d) %d bytes%s",
+			buffid, start, end, end-start, note,
+		)
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE:
+		t := self.transfer(buffid, e.time)
+		t.outcome = "completed"
+		self.printf(e, id, method, "complete buffer %s digest=%s", buffid, short(str(p, "d"), 16))
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED:
+		t := self.transfer(buffid, e.time)
+		t.outcome = "failed: " + str(p, "r")
+		self.printf(e, id, method, "FAILED buffer %s: %s", buffid, str(p, "r"))
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_AUTH_CHALLENGE:
+		self.printf(e, id, method, "auth challenge?")
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE:
+		self.printf(e, id, method, "auth response identity=%q", str(p, "i"))
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_PING:
+		self.printf(e, id, method, "ping")
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GOAWAY:
+		self.printf(e, id, method, "going away")
+
+	default:
+		b, _ := json.Marshal(m["params"])
+		self.printf(e, id, method, "unknown method, params: %s", short(string(b), 80))
+	}
+}
+
+func (self *Dumper) response(e *event, id string, m message) {
+	key := opposite(e.dir) + "/" + id
+	req, ok := self.pending[key]
+	if ok {
+		delete(self.pending, key)
+	}
+
+	if errobj, is_error := m["error"].(map[string]any); is_error {
+		self.errors++
+		code, _ := number(errobj, "code")
+
+		on := "unknown request"
+		if req != nil {
+			on = req.method
+			if req.buffid != "" {
+				on += " buffer " + req.buffid
+				self.transfer(req.buffid, e.time).errors++
+			}
+		}
+
+		self.printf(e, id, "ERR", "%d %s (on %s)", code, str(errobj, "message"), on)
+		return
+	}
+
+	if req == nil {
+		b, _ := json.Marshal(m["result"])
+		self.printf(e, id, "res", "result on unknown request: %s", short(string(b), 80))
+		return
+	}
+
+	result, _ := m["result"].(map[string]any)
+
+	switch req.method {
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO:
+		size, ok := number(result, "s")
+		if !ok {
+			self.printf(e, id, "res", "info: no size")
+			return
+		}
+		self.transfer(req.buffid, e.time).size = size
+		self.printf(e, id, "res", "info: buffer %s size %d", req.buffid, size)
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE:
+		t := self.transfer(req.buffid, e.time)
+
+		data, err := base64.RawStdEncoding.DecodeString(str(result, "data"))
+		if err != nil {
+			t.errors++
+			self.printf(e, id, "res", "slice: can't decode data: %v", err)
+			return
+		}
+
+		expected := req.rng.end - req.rng.start
+		note := ""
+		if int64(len(data)) != expected {
+			t.errors++
+			note = fmt.Sprintf(" SIZE MISMATCH, expected %d", expected)
+		} else {
+			t.slices_received++
+			t.bytes_received += int64(len(data))
+			t.received = append(t.received, req.rng)
+		}
+
+		self.printf(
+			e, id, "res",
+			"slice: buffer %s [%d, %d) %d bytes%s",
+			req.buffid, req.rng.start, req.rng.end, len(data), note,
+		)
+
+	case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_AUTH_RESPONSE:
+		ok, _ := result["ok"].(bool)
+		self.printf(e, id, "res", "auth ok=%v", ok)
+
+	default:
+		desc := "ack " + req.method
+		if req.buffid != "" {
+			desc += " buffer " + req.buffid
+		}
+		self.printf(e, id, "res", "%s", desc)
+	}
+}
+
+// ranges of [0, size), not covered by 'received'
+func missingRanges(size int64, received []byteRange) []byteRange {
+	sorted := append([]byteRange(nil), received...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	var ret []byteRange
+	pos := int64(0)
+	for _, r := range sorted {
+		if r.start > pos {
+			ret = append(ret, byteRange{pos, r.start})
+		}
+		if r.end > pos {
+			pos = r.end
+		}
+	}
+	if pos < size {
+		ret = append(ret, byteRange{pos, size})
+	}
+	return ret
+}
+
+func (self *Dumper) Summary() {
+	fmt.Fprintln(self.out)
+
+	methods := make([]string, 0, len(self.messages))
+	for k := range self.messages {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+
+	counts := make([]string, 0, len(methods))
+	for _, k := range methods {
+		counts = append(counts, fmt.Sprintf("%s=%d", k, self.messages[k]))
+	}
+
+	fmt.Fprintf(
+		self.out,
+		"requests: %s; responses: %d; errors: %d; invalid: %d; unanswered: %d\n",
+		strings.Join(counts, " "),
+		self.responses,
+		self.errors,
+		self.invalid,
+		len(self.pending),
+	)
+
+	fmt.Fprintf(self.out, "transfers: %d\n", len(self.transfers_order))
+
+	for _, buffid := range self.transfers_order {
+		t := self.transfers[buffid]
+
+		dir := t.dir
+		if dir == "" {
+			dir = "not announced"
+		}
+
+		size := "?"
+		if t.size >= 0 {
+			size = fmt.Sprint(t.size)
+		}
+
+		outcome := t.outcome
+		if outcome == "" {
+			outcome = "no outcome"
+		}
+
+		duration := ""
+		if !t.first.IsZero() && !t.last.IsZero() {
+			duration = ", " + t.last.Sub(t.first).Round(time.Microsecond).String()
+		}
+
+		fmt.Fprintf(
+			self.out,
+			"  %s (%s) priority=%s size=%s: %d/%d slices, %d bytes, %d retries, %d errors, %s%s\n",
+			buffid, dir, t.priority, size,
+			t.slices_received, t.slices_requested,
+			t.bytes_received, t.retries, t.errors,
+			outcome, duration,
+		)
+
+		if t.reply_to != "" {
+			fmt.Fprintf(self.out, "    reply to %s\n", t.reply_to)
+		}
+
+		if t.size >= 0 {
+			missing := missingRanges(t.size, t.received)
+			if len(missing) != 0 {
+				parts := make([]string, 0, len(missing))
+				for _, r := range missing {
+					parts = append(parts, fmt.Sprintf("[%d, %d)", r.start, r.end))
+				}
+				fmt.Fprintf(self.out, "    missing: %s\n", strings.Join(parts, " "))
+			}
+		}
+	}
+}
+
+func readJSONL(r io.Reader, cb func(*event)) error {
+	reader := gojsonrpc2datastreammultiplexer.NewJSONRPC2DataStreamMultiplexerRecordReader(r)
+	for i := 1; ; i++ {
+		rec, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		cb(&event{index: i, time: rec.Time, dir: rec.Direction, data: rec.Data})
+	}
+}
+
+func readFrames(r io.Reader, dir string, cb func(*event)) error {
+	for i := 1; ; i++ {
+		data, err := gojsonrpc2datastreammultiplexer.ReadJSONRPC2DataStreamMultiplexerFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		cb(&event{index: i, dir: dir, data: data})
+	}
+}
+
+func main() {
+	format := flag.String("format", "auto", "input format: auto, jsonl or frames")
+	dir := flag.String("dir", "?", "direction of frames: in, out or ?")
+	gap := flag.Duration("gap", time.Second, "mark pauses longer than this (0 - don't)")
+	quiet := flag.Bool("q", false, "print only summary")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [file|-]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var input io.Reader = os.Stdin
+	if flag.NArg() == 1 && flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	buffered := bufio.NewReader(input)
+
+	if *format == "auto" {
+		// frame starts with zero byte (length < 16MiB), record - with '{'
+		b, err := buffered.Peek(1)
+		if err == nil && b[0] == '{' {
+			*format = "jsonl"
+		} else {
+			*format = "frames"
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	d := NewDumper(out)
+	d.gap = *gap
+	d.quiet = *quiet
+
+	var err error
+	switch *format {
+	case "jsonl":
+		err = readJSONL(buffered, d.Event)
+	case "frames":
+		err = readFrames(buffered, *dir, d.Event)
+	default:
+		out.Flush()
+		fmt.Fprintln(os.Stderr, "invalid -format value:", *format)
+		os.Exit(2)
+	}
+
+	d.Summary()
+
+	if err != nil {
+		out.Flush()
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
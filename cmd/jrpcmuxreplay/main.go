@@ -0,0 +1,598 @@
+// jrpcmuxreplay replays recording, made with
+// JSONRPC2DataStreamMultiplexerRecorder, against fresh multiplexer and
+// reports where it's behaviour diverges from recorded one.
+//
+// recording is made on one side of the link. "in" messages are pushed into
+// fresh multiplexer; "out" messages are expected to be produced by it.
+// request ids and buffer ids, generated by fresh multiplexer, are different
+// from recorded ones, so they are remapped: ids in "in" messages are
+// rewritten, ids in "out" messages are compared after mapping.
+//
+// transfers started by application on recorded side ("out" "n" requests) are
+// started again with data, reconstructed from recorded "gbs" responses.
+// other requests started by application (authentication, ping, goaway) can't
+// be reproduced: they and responses on them are skipped.
+//
+// options of restarted transfers are taken from recorded "n" request
+// (priority, rate limit, idle expiry, wants reply). Audience isn't sent to
+// peer: if recorded side refused peer's gbi/gbs for buffer as not
+// authorized, buffer is restarted with Audience, which fresh multiplexer's
+// peer can't match.
+//
+// usage:
+//
+//	jrpcmuxreplay [-timeout 5s] [-settle 500ms] [-v] recording.jsonl
+//
+// exit status is 1 if behaviour diverged, 2 on other errors.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	gojsonrpc2datastreammultiplexer "github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer"
+)
+
+type message = map[string]any
+
+const (
+	method_n   = gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_NEW_BUFFER_AVAILABLE
+	method_gbi = gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_INFO
+	method_gbs = gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_GET_BUFFER_SLICE
+	method_tc  = gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_COMPLETE
+	method_tf  = gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_METHOD_TRANSFER_FAILED
+)
+
+// fresh multiplexer's peer has no identity, so any not empty Audience
+// refuses it
+const unmatched_audience = "jrpcmuxreplay: not authorized"
+
+// requests, which multiplexer makes by itself (as part of transfer)
+var transfer_methods = map[string]bool{
+	method_n:   true,
+	method_gbi: true,
+	method_gbs: true,
+	method_tc:  true,
+	method_tf:  true,
+}
+
+func decodeMessage(data []byte) (message, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var ret message
+	err := dec.Decode(&ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, errors.New("message isn't json object")
+	}
+
+	return ret, nil
+}
+
+// key for id maps
+func idKey(id any) string {
+	b, _ := json.Marshal(id)
+	return string(b)
+}
+
+func summary(data []byte) string {
+	const max = 300
+	if len(data) > max {
+		return string(data[:max]) + "..."
+	}
+	return string(data)
+}
+
+func method(m message) string {
+	ret, _ := m["method"].(string)
+	return ret
+}
+
+func params(m message) map[string]any {
+	ret, _ := m["params"].(map[string]any)
+	return ret
+}
+
+func number(v any) (int64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	ret, err := n.Int64()
+	return ret, err == nil
+}
+
+func isResponse(m message) bool {
+	_, ok := m["method"]
+	return !ok
+}
+
+type Replayer struct {
+	multiplexer *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer
+
+	records []*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerRecord
+
+	produced_mutex sync.Mutex
+	produced       [][]byte
+	produced_chan  chan struct{}
+
+	// recorded id -> replayed id
+	request_ids map[string]any
+	buffer_ids  map[string]string
+
+	// ids of requests, which aren't reproduced
+	skipped_ids map[string]bool
+
+	// recorded buffer id -> data, reconstructed from recording
+	buffers map[string][]byte
+	// recorded buffer ids, reads of which were refused as not authorized
+	unauthorized map[string]bool
+	// data for replies ("n" with "rt"), in recorded order.
+	// protected by replies_mutex
+	replies_mutex sync.Mutex
+	replies       [][]byte
+
+	timeout time.Duration
+	settle  time.Duration
+	verbose bool
+
+	divergences int
+}
+
+func NewReplayer(
+	records []*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerRecord,
+) *Replayer {
+	self := new(Replayer)
+	self.records = records
+	self.produced_chan = make(chan struct{}, 1)
+	self.request_ids = make(map[string]any)
+	self.buffer_ids = make(map[string]string)
+	self.skipped_ids = make(map[string]bool)
+
+	self.multiplexer = gojsonrpc2datastreammultiplexer.NewJSONRPC2DataStreamMultiplexer()
+	self.multiplexer.PushMessageToOutsideCB = func(data []byte) error {
+		self.produced_mutex.Lock()
+		self.produced = append(self.produced, append([]byte(nil), data...))
+		self.produced_mutex.Unlock()
+
+		select {
+		case self.produced_chan <- struct{}{}:
+		default:
+		}
+
+		return nil
+	}
+	self.multiplexer.OnIncommingDataTransferComplete = func(io.WriteSeeker) {}
+	self.multiplexer.OnIncommingDataTransferReplyCB = func(io.WriteSeeker) (io.ReadSeeker, error) {
+		self.replies_mutex.Lock()
+		defer self.replies_mutex.Unlock()
+
+		if len(self.replies) == 0 {
+			return nil, errors.New("no reply in recording")
+		}
+		ret := self.replies[0]
+		self.replies = self.replies[1:]
+		return bytes.NewReader(ret), nil
+	}
+
+	return self
+}
+
+func (self *Replayer) diverged(index int, format string, args ...any) {
+	self.divergences++
+	fmt.Printf("#%d: DIVERGENCE: %s\n", index+1, fmt.Sprintf(format, args...))
+}
+
+func (self *Replayer) note(index int, format string, args ...any) {
+	if self.verbose {
+		fmt.Printf("#%d: %s\n", index+1, fmt.Sprintf(format, args...))
+	}
+}
+
+// restores data of buffers, announced by recorded side, from it's
+// responses on peer's gbi/gbs requests
+func (self *Replayer) reconstructBuffers() {
+	self.buffers = make(map[string][]byte)
+	self.unauthorized = make(map[string]bool)
+
+	// in request id -> it's params
+	gbi_requests := make(map[string]string)
+	gbs_requests := make(map[string]map[string]any)
+
+	for _, rec := range self.records {
+		m, err := decodeMessage(rec.Data)
+		if err != nil {
+			continue
+		}
+
+		if rec.Direction == gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_IN {
+			p := params(m)
+			id, _ := p["id"].(string)
+			switch method(m) {
+			case method_gbi:
+				gbi_requests[idKey(m["id"])] = id
+			case method_gbs:
+				gbs_requests[idKey(m["id"])] = p
+			}
+			continue
+		}
+
+		if !isResponse(m) {
+			continue
+		}
+
+		key := idKey(m["id"])
+
+		if e, ok := m["error"].(map[string]any); ok {
+			code, _ := number(e["code"])
+			if code == gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_ERROR_CODE_NOT_AUTHORIZED {
+				if buffid, ok := gbi_requests[key]; ok {
+					self.unauthorized[buffid] = true
+				}
+				if p, ok := gbs_requests[key]; ok {
+					buffid, _ := p["id"].(string)
+					self.unauthorized[buffid] = true
+				}
+			}
+			continue
+		}
+
+		result, ok := m["result"].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if buffid, ok := gbi_requests[key]; ok {
+			size, ok := number(result["s"])
+			if ok && size >= 0 && len(self.buffers[buffid]) == 0 {
+				self.buffers[buffid] = make([]byte, size)
+			}
+			continue
+		}
+
+		if p, ok := gbs_requests[key]; ok {
+			buffid, _ := p["id"].(string)
+			start, ok := number(p["start"])
+			if !ok {
+				continue
+			}
+			data_str, _ := result["data"].(string)
+			data, err := base64.RawStdEncoding.DecodeString(data_str)
+			if err != nil {
+				continue
+			}
+			buff := self.buffers[buffid]
+			if start < 0 || start+int64(len(data)) > int64(len(buff)) {
+				continue
+			}
+			copy(buff[start:], data)
+		}
+	}
+
+	// replies are requested by multiplexer before it announces them
+	for _, rec := range self.records {
+		if rec.Direction != gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_OUT {
+			continue
+		}
+		m, err := decodeMessage(rec.Data)
+		if err != nil || method(m) != method_n {
+			continue
+		}
+		p := params(m)
+		if rt, _ := p["rt"].(string); rt != "" {
+			buffid, _ := p["id"].(string)
+			self.replies = append(self.replies, self.buffers[buffid])
+		}
+	}
+}
+
+// rewrites ids in "in" message. returns false, if message is response on
+// request, which wasn't reproduced
+func (self *Replayer) remapIn(m message) bool {
+	if isResponse(m) {
+		key := idKey(m["id"])
+		if self.skipped_ids[key] {
+			return false
+		}
+		if id, ok := self.request_ids[key]; ok {
+			m["id"] = id
+		}
+		return true
+	}
+
+	p := params(m)
+	if p == nil {
+		return true
+	}
+
+	field := ""
+	switch method(m) {
+	case method_gbi, method_gbs, method_tc, method_tf:
+		field = "id"
+	case method_n:
+		field = "rt"
+	}
+
+	if field != "" {
+		if id, ok := p[field].(string); ok {
+			if replayed, ok := self.buffer_ids[id]; ok {
+				p[field] = replayed
+			}
+		}
+	}
+
+	return true
+}
+
+// takes next produced message, which 'matches' recorded one: response with
+// same id or request with same method
+func (self *Replayer) takeProduced(recorded message) (message, []byte, bool) {
+	deadline := time.After(self.timeout)
+
+	for {
+		self.produced_mutex.Lock()
+		for i, data := range self.produced {
+			m, err := decodeMessage(data)
+			if err != nil {
+				continue
+			}
+
+			var match bool
+			if isResponse(recorded) {
+				match = isResponse(m) && idKey(m["id"]) == idKey(recorded["id"])
+			} else {
+				match = method(m) == method(recorded)
+			}
+
+			if match {
+				self.produced = append(self.produced[:i], self.produced[i+1:]...)
+				self.produced_mutex.Unlock()
+				return m, data, true
+			}
+		}
+		self.produced_mutex.Unlock()
+
+		select {
+		case <-self.produced_chan:
+		case <-deadline:
+			return nil, nil, false
+		}
+	}
+}
+
+// starts transfer, application started on recorded side
+func (self *Replayer) startTransfer(index int, recorded message) {
+	p := params(recorded)
+	buffid, _ := p["id"].(string)
+
+	if rt, _ := p["rt"].(string); rt != "" {
+		// reply is started by multiplexer itself, on incomming "n" with "w".
+		// see reconstructBuffers()
+		return
+	}
+
+	data, ok := self.buffers[buffid]
+	if !ok {
+		self.note(index, "data of buffer %s isn't in recording. using empty buffer", buffid)
+	}
+
+	options := new(gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerChannelDataOptions)
+	if v, ok := number(p["p"]); ok {
+		options.Priority = gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerPriority(v)
+	}
+	if v, ok := number(p["r"]); ok {
+		options.RateLimit = v
+	}
+	if v, ok := number(p["x"]); ok && v > 0 {
+		options.IdleExpiry = time.Duration(v) * time.Millisecond
+	}
+	if self.unauthorized[buffid] {
+		options.Audience = unmatched_audience
+	}
+
+	wants_reply, _ := p["w"].(bool)
+
+	go func() {
+		var (
+			timedout  bool
+			closed    bool
+			proto_err error
+			err       error
+		)
+		if wants_reply {
+			timedout, closed, _, proto_err, err =
+				self.multiplexer.ChannelDataReaderWithReply(bytes.NewReader(data), options)
+		} else {
+			timedout, closed, _, proto_err, err =
+				self.multiplexer.ChannelDataReaderWithOptions(bytes.NewReader(data), options)
+		}
+		self.note(
+			index,
+			"transfer of buffer %s finished: timedout=%v closed=%v proto_err=%v err=%v",
+			buffid, timedout, closed, proto_err, err,
+		)
+	}()
+}
+
+func (self *Replayer) expectOut(index int, recorded message) {
+	if !isResponse(recorded) &&
+		!transfer_methods[method(recorded)] {
+		self.skipped_ids[idKey(recorded["id"])] = true
+		self.note(index, "skipped: %q is started by application", method(recorded))
+		return
+	}
+
+	if method(recorded) == method_n {
+		self.startTransfer(index, recorded)
+	}
+
+	got, got_data, ok := self.takeProduced(recorded)
+	if !ok {
+		what := "response"
+		if !isResponse(recorded) {
+			what = fmt.Sprintf("%q request", method(recorded))
+		}
+		self.diverged(index, "expected %s, nothing produced in %v", what, self.timeout)
+		return
+	}
+
+	// establish mappings for ids, generated by fresh multiplexer
+	if !isResponse(recorded) {
+		if id, ok := recorded["id"]; ok {
+			self.request_ids[idKey(id)] = got["id"]
+			recorded["id"] = got["id"]
+		}
+	}
+
+	if method(recorded) == method_n {
+		rec_id, _ := params(recorded)["id"].(string)
+		got_id, _ := params(got)["id"].(string)
+		self.buffer_ids[rec_id] = got_id
+		params(recorded)["id"] = got_id
+	}
+
+	// trace context is different on each run
+	for _, m := range []message{recorded, got} {
+		if p := params(m); p != nil {
+			delete(p, "t")
+		}
+	}
+
+	if !reflect.DeepEqual(recorded, got) {
+		rec_data, _ := json.Marshal(recorded)
+		self.diverged(
+			index,
+			"produced message differs\n  recorded: %s\n  produced: %s",
+			summary(rec_data),
+			summary(got_data),
+		)
+		return
+	}
+
+	self.note(index, "out ok: %s", summary(got_data))
+}
+
+func (self *Replayer) pushIn(index int, rec *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerRecord) {
+	data := rec.Data
+
+	m, err := decodeMessage(data)
+	if err == nil {
+		if !self.remapIn(m) {
+			self.note(index, "skipped: response on not reproduced request")
+			return
+		}
+		data, err = json.Marshal(m)
+		if err != nil {
+			self.diverged(index, "can't encode remapped message: %v", err)
+			return
+		}
+	}
+
+	proto_err, err := self.multiplexer.PushMessageFromOutside(data)
+	if proto_err != nil || err != nil {
+		self.note(index, "in rejected: proto_err=%v err=%v", proto_err, err)
+		return
+	}
+
+	self.note(index, "in: %s", summary(data))
+}
+
+func (self *Replayer) Run() int {
+	self.reconstructBuffers()
+
+	for i, rec := range self.records {
+		switch rec.Direction {
+		case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_IN:
+			self.pushIn(i, rec)
+		case gojsonrpc2datastreammultiplexer.JSONRPC2_MULTIPLEXER_RECORD_OUT:
+			recorded, err := decodeMessage(rec.Data)
+			if err != nil {
+				self.note(i, "skipped: recorded message isn't valid: %v", err)
+				continue
+			}
+			self.expectOut(i, recorded)
+		}
+	}
+
+	// anything produced, but not recorded
+	time.Sleep(self.settle)
+
+	self.produced_mutex.Lock()
+	extra := self.produced
+	self.produced = nil
+	self.produced_mutex.Unlock()
+
+	for _, data := range extra {
+		self.diverged(len(self.records), "unexpected message produced: %s", summary(data))
+	}
+
+	fmt.Printf(
+		"%d records replayed, %d divergences\n",
+		len(self.records),
+		self.divergences,
+	)
+
+	return self.divergences
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	timeout := flag.Duration("timeout", 5*time.Second, "how long to wait for each expected message")
+	settle := flag.Duration("settle", 500*time.Millisecond, "how long to wait for unexpected messages after last record")
+	verbose := flag.Bool("v", false, "print every replayed message")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] recording.jsonl|-\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return 2
+	}
+
+	var input io.Reader = os.Stdin
+	if flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		input = f
+	}
+
+	records, err := gojsonrpc2datastreammultiplexer.ReadJSONRPC2DataStreamMultiplexerRecording(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	r := NewReplayer(records)
+	r.timeout = *timeout
+	r.settle = *settle
+	r.verbose = *verbose
+
+	if r.Run() != 0 {
+		return 1
+	}
+
+	return 0
+}
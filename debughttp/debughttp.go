@@ -0,0 +1,172 @@
+// debug page for JSONRPC2DataStreamMultiplexer.
+//
+// Handler renders state of registered multiplexers: Stats(), ListTransfers(),
+// RecentErrors() and counters (if multiplexer's Metrics is
+// *JSONRPC2DataStreamMultiplexerCountingMetrics).
+//
+// Handler uses only query parameters, so it can be mounted on any path:
+//
+//	h := debughttp.NewHandler()
+//	h.Register("peer1", mux1)
+//	http.Handle("/debug/jrpcmux", h)
+//
+// query parameters:
+//
+//	format=json - JSON instead of HTML
+//	name=<name> - show only multiplexer registered with <name>
+//
+// failures to render page (usually client went away) are logged with
+// loggers of shown multiplexers, at Info level: they aren't multiplexer's
+// errors, so they don't go to RecentErrors().
+package debughttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	gojsonrpc2datastreammultiplexer "github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer"
+)
+
+type Handler struct {
+	mutex        sync.Mutex
+	multiplexers map[string]*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer
+}
+
+func NewHandler() *Handler {
+	self := new(Handler)
+	self.multiplexers = make(map[string]*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer)
+	return self
+}
+
+// registering with same name replaces previous multiplexer
+func (self *Handler) Register(
+	name string,
+	multiplexer *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer,
+) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.multiplexers[name] = multiplexer
+}
+
+func (self *Handler) Unregister(name string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.multiplexers, name)
+}
+
+// state of one multiplexer, as rendered by Handler
+type MultiplexerState struct {
+	Name         string
+	Time         time.Time
+	Stats        *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerStats
+	Transfers    *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerTransfers
+	Counters     *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerMetricsSnapshot `json:",omitempty"`
+	RecentErrors []gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerErrorRecord
+}
+
+// registered multiplexers and their sorted names.
+// name == "" - all multiplexers
+func (self *Handler) selectMultiplexers(name string) (
+	[]string,
+	map[string]*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer,
+) {
+	self.mutex.Lock()
+	names := make([]string, 0, len(self.multiplexers))
+	multiplexers := make(
+		map[string]*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexer,
+		len(self.multiplexers),
+	)
+	for k, v := range self.multiplexers {
+		if name != "" && k != name {
+			continue
+		}
+		names = append(names, k)
+		multiplexers[k] = v
+	}
+	self.mutex.Unlock()
+
+	sort.Strings(names)
+
+	return names, multiplexers
+}
+
+// state of registered multiplexers, sorted by name.
+// name == "" - all multiplexers
+func (self *Handler) State(name string) []*MultiplexerState {
+	names, multiplexers := self.selectMultiplexers(name)
+
+	ret := make([]*MultiplexerState, 0, len(names))
+	for _, k := range names {
+		m := multiplexers[k]
+
+		state := &MultiplexerState{
+			Name:         k,
+			Time:         time.Now(),
+			Stats:        m.Stats(),
+			Transfers:    m.ListTransfers(),
+			RecentErrors: m.RecentErrors(),
+		}
+
+		counting, ok := m.Metrics.(*gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerCountingMetrics)
+		if ok && counting != nil {
+			state.Counters = counting.Snapshot()
+		}
+
+		ret = append(ret, state)
+	}
+
+	return ret
+}
+
+func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+
+	state := self.State(name)
+	if name != "" && len(state) == 0 {
+		http.Error(w, "multiplexer not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if query.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(state)
+		if err != nil {
+			self.logRenderError(name, r, "json", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := page_template.Execute(w, state)
+	if err != nil {
+		self.logRenderError(name, r, "html", err)
+	}
+}
+
+func (self *Handler) logRenderError(name string, r *http.Request, format string, err error) {
+	names, multiplexers := self.selectMultiplexers(name)
+	for _, k := range names {
+		multiplexers[k].GetLogger().Info(
+			"debug page not rendered",
+			"format", format,
+			"remote_addr", r.RemoteAddr,
+			"err", err,
+		)
+	}
+}
@@ -0,0 +1,51 @@
+package debughttp
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gojsonrpc2datastreammultiplexer "github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer"
+)
+
+// client, which went away
+type failingResponseWriter struct {
+	header http.Header
+}
+
+func (self *failingResponseWriter) Header() http.Header { return self.header }
+func (self *failingResponseWriter) WriteHeader(int)     {}
+func (self *failingResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestRenderErrorsLogged(t *testing.T) {
+	for _, format := range []string{"json", "html"} {
+		log := new(bytes.Buffer)
+
+		mux := gojsonrpc2datastreammultiplexer.NewJSONRPC2DataStreamMultiplexer()
+		mux.SetLogger(slog.New(slog.NewTextHandler(log, nil)))
+		defer mux.Close()
+
+		h := NewHandler()
+		h.Register("peer1", mux)
+
+		h.ServeHTTP(
+			&failingResponseWriter{header: make(http.Header)},
+			httptest.NewRequest(http.MethodGet, "/?format="+format, nil),
+		)
+
+		if !strings.Contains(log.String(), "debug page not rendered") ||
+			!strings.Contains(log.String(), "connection reset") {
+			t.Fatalf("%s: render error not logged: %q", format, log.String())
+		}
+
+		if len(mux.RecentErrors()) != 0 {
+			t.Fatalf("%s: render error recorded as multiplexer's error", format)
+		}
+	}
+}
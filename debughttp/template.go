@@ -0,0 +1,145 @@
+package debughttp
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"time"
+
+	gojsonrpc2datastreammultiplexer "github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer"
+)
+
+var page_template = template.Must(
+	template.New("page").Funcs(
+		template.FuncMap{
+			"duration": func(d time.Duration) string {
+				return d.Round(time.Millisecond).String()
+			},
+			"percent": func(done int64, size int64) string {
+				if size <= 0 {
+					return "-"
+				}
+				return fmt.Sprintf("%.1f%%", float64(done)*100/float64(size))
+			},
+			"clock": func(t time.Time) string {
+				return t.Format("15:04:05.000")
+			},
+			"methods": snapshotMethods,
+		},
+	).Parse(page_template_text),
+)
+
+// sorted names of methods, mentioned in any of snapshot's counters
+func snapshotMethods(
+	s *gojsonrpc2datastreammultiplexer.JSONRPC2DataStreamMultiplexerMetricsSnapshot,
+) []string {
+	set := make(map[string]struct{})
+	for _, m := range []map[string]uint64{
+		s.MessagesIn,
+		s.MessagesOut,
+		s.Retries,
+		s.Timeouts,
+		s.ProtocolErrors,
+	} {
+		for k := range m {
+			set[k] = struct{}{}
+		}
+	}
+
+	ret := make([]string, 0, len(set))
+	for k := range set {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+const page_template_text = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>jsonrpc2 data stream multiplexers</title>
+<style>
+body { font-family: monospace; font-size: 13px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+th { background: #eee; }
+h2 { margin-bottom: 0.2em; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+{{if not .}}<p>no multiplexers registered</p>{{end}}
+{{range .}}
+<h2>{{.Name}}</h2>
+<p>
+<a href="?name={{.Name}}">only this</a> |
+<a href="?name={{.Name}}&amp;format=json">json</a> |
+rendered at {{clock .Time}}
+</p>
+
+{{with .Stats}}
+<table>
+<tr><th>debug name</th><td>{{.Name}}</td></tr>
+<tr><th>peer</th><td>{{.PeerIdentity}}{{if not .PeerAuthenticated}} <span class="bad">(not authenticated)</span>{{end}}{{if .PeerGoingAway}} <span class="bad">(going away)</span>{{end}}</td></tr>
+<tr><th>state</th><td>{{if .Closed}}<span class="bad">closed</span>{{else if .ShuttingDown}}<span class="bad">shutting down</span>{{else}}open{{end}}</td></tr>
+<tr><th>rtt</th><td>{{if .RTTKnown}}{{duration .RTT}}{{else}}-{{end}}</td></tr>
+<tr><th>outgoing transfers</th><td>{{.OutgoingTransfers}} ({{.OutgoingBytesServed}} bytes served)</td></tr>
+<tr><th>incomming transfers</th><td>{{.IncommingTransfers}} ({{.IncommingBytesReceived}} bytes received, {{.IncommingRetries}} retries)</td></tr>
+<tr><th>queued pulls</th><td>{{.QueuedPulls}}</td></tr>
+<tr><th>slices in flight</th><td>{{.SlicesInFlight}}</td></tr>
+</table>
+{{end}}
+
+<h3>outgoing transfers</h3>
+{{with .Transfers.Outgoing}}
+<table>
+<tr><th>buffer</th><th>audience</th><th>priority</th><th>state</th><th>size</th><th>served</th><th></th><th>age</th><th>last access</th></tr>
+{{range .}}
+<tr><td>{{.BufferId}}</td><td>{{.Audience}}</td><td>{{.Priority}}</td><td>{{.State}}</td><td>{{.Size}}</td><td>{{.BytesServed}}</td><td>{{percent .BytesServed .Size}}</td><td>{{duration .Age}}</td><td>{{clock .LastAccess}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>none</p>{{end}}
+
+<h3>incomming transfers</h3>
+{{with .Transfers.Incomming}}
+<table>
+<tr><th>buffer</th><th>priority</th><th>size</th><th>received</th><th></th><th>retries</th><th>current slice</th><th>age</th></tr>
+{{range .}}
+<tr><td>{{.BufferId}}</td><td>{{.Priority}}</td><td>{{if lt .Size 0}}?{{else}}{{.Size}}{{end}}</td><td>{{.BytesReceived}}</td><td>{{percent .BytesReceived .Size}}</td><td>{{.Retries}}</td><td>{{if .SliceEnd}}{{.SliceStart}}-{{.SliceEnd}}{{else}}-{{end}}</td><td>{{duration .Age}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>none</p>{{end}}
+
+{{with .Counters}}
+<h3>counters</h3>
+<table>
+<tr><th>bytes sent</th><td>{{.BytesSent}}</td></tr>
+<tr><th>bytes received</th><td>{{.BytesReceived}}</td></tr>
+<tr><th>outgoing transfers ok / failed</th><td>{{.OutgoingTransfersOk}} / {{.OutgoingTransfersFailed}}</td></tr>
+<tr><th>incomming transfers ok / failed</th><td>{{.IncommingTransfersOk}} / {{.IncommingTransfersFailed}}</td></tr>
+<tr><th>slice latency</th><td>{{.SliceLatency.Count}} slices, {{printf "%.3f" .SliceLatency.Sum}}s total</td></tr>
+</table>
+<table>
+<tr><th>method</th><th>in</th><th>out</th><th>retries</th><th>timeouts</th><th>protocol errors</th></tr>
+{{$s := .}}
+{{range $method := methods .}}
+<tr><td>{{$method}}</td><td>{{index $s.MessagesIn $method}}</td><td>{{index $s.MessagesOut $method}}</td><td>{{index $s.Retries $method}}</td><td>{{index $s.Timeouts $method}}</td><td>{{index $s.ProtocolErrors $method}}</td></tr>
+{{end}}
+</table>
+{{end}}
+
+<h3>recent errors</h3>
+{{with .RecentErrors}}
+<table>
+<tr><th>time</th><th>level</th><th>message</th><th>fields</th></tr>
+{{range .}}
+<tr><td>{{clock .Time}}</td><td>{{.Level}}</td><td>{{.Message}}</td><td>{{range $k, $v := .Attrs}}{{$k}}={{$v}} {{end}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>none</p>{{end}}
+{{end}}
+</body>
+</html>
+`
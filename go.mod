@@ -1,6 +1,6 @@
 module github.com/AnimusPEXUS/gojsonrpc2datastreammultiplexer
 
-go 1.20
+go 1.21
 
 require (
 	github.com/AnimusPEXUS/goinmemfile v0.0.0-20230615005913-b987d11ee924